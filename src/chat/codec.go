@@ -0,0 +1,213 @@
+package chat
+
+import (
+	"bytes"
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"log"
+	"scale-chat/chatpb"
+)
+
+// SubprotocolPrefix is prepended to a codec's name to build the websocket subprotocol that selects the codec
+const SubprotocolPrefix = "scale-chat."
+
+// Codec encodes and decodes Messages for the wire
+type Codec interface {
+	// Name identifies the codec, e.g. in command line flags
+	Name() string
+	// Binary indicates whether encoded messages have to be sent as binary instead of text frames
+	Binary() bool
+	Marshal(msg *Message) ([]byte, error)
+	Unmarshal(data []byte, msg *Message) error
+}
+
+// Codecs that are supported by the server. The first one is the default.
+var Codecs = []Codec{JSONCodec{}, MsgPackCodec{}, ProtobufCodec{}}
+
+// Subprotocol returns the websocket subprotocol of the supplied codec
+func Subprotocol(codec Codec) string {
+	return SubprotocolPrefix + codec.Name()
+}
+
+// Subprotocols returns the websocket subprotocols of all supported codecs in the order of preference
+func Subprotocols() []string {
+	protocols := make([]string, 0, len(Codecs))
+	for _, codec := range Codecs {
+		protocols = append(protocols, Subprotocol(codec))
+	}
+	return protocols
+}
+
+// CodecByName returns the codec with the supplied name
+func CodecByName(name string) (Codec, bool) {
+	for _, codec := range Codecs {
+		if codec.Name() == name {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+// CodecBySubprotocol returns the codec that was negotiated via the supplied websocket subprotocol.
+// Clients that did not negotiate a subprotocol get the default codec.
+func CodecBySubprotocol(protocol string) (Codec, bool) {
+	if protocol == "" {
+		return Codecs[0], true
+	}
+
+	for _, codec := range Codecs {
+		if Subprotocol(codec) == protocol {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+// JSONCodec encodes Messages as JSON text
+type JSONCodec struct{}
+
+func (JSONCodec) Name() string {
+	return "json"
+}
+
+func (JSONCodec) Binary() bool {
+	return false
+}
+
+func (JSONCodec) Marshal(msg *Message) ([]byte, error) {
+	return msg.MarshalBinary()
+}
+
+func (JSONCodec) Unmarshal(data []byte, msg *Message) error {
+	return msg.UnmarshalBinary(data)
+}
+
+// MsgPackCodec encodes Messages with MessagePack using the same field names as the JSON encoding
+type MsgPackCodec struct{}
+
+func (MsgPackCodec) Name() string {
+	return "msgpack"
+}
+
+func (MsgPackCodec) Binary() bool {
+	return true
+}
+
+func (MsgPackCodec) Marshal(msg *Message) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := msgpack.NewEncoder(&buffer)
+	encoder.SetCustomStructTag("json")
+
+	err := encoder.Encode(msg)
+	if err != nil {
+		log.Printf("Cannot marshal message: %v", err)
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (MsgPackCodec) Unmarshal(data []byte, msg *Message) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+
+	err := decoder.Decode(msg)
+	if err != nil {
+		log.Printf("Cannot parse message: %v", err)
+		return err
+	}
+	return nil
+}
+
+// ProtobufCodec encodes Messages as chatpb.Message
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) Name() string {
+	return "protobuf"
+}
+
+func (ProtobufCodec) Binary() bool {
+	return true
+}
+
+func (ProtobufCodec) Marshal(msg *Message) ([]byte, error) {
+	data, err := proto.Marshal(msg.ToProto())
+	if err != nil {
+		log.Printf("Cannot marshal message: %v", err)
+		return nil, err
+	}
+	return data, nil
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, msg *Message) error {
+	var pbMsg chatpb.Message
+	err := proto.Unmarshal(data, &pbMsg)
+	if err != nil {
+		log.Printf("Cannot parse message: %v", err)
+		return err
+	}
+
+	*msg = MessageFromProto(&pbMsg)
+	return nil
+}
+
+// ToProto converts a Message to its protobuf representation
+func (msg *Message) ToProto() *chatpb.Message {
+	pbMsg := &chatpb.Message{
+		Id:        msg.Id,
+		Type:      msg.Type,
+		MessageId: msg.MessageId,
+		Text:      msg.Text,
+		Sender:    msg.Sender,
+		SentAt:    timestamppb.New(msg.SentAt),
+		Room:      msg.Room,
+		ParentId:  msg.ParentId,
+		Target:    msg.Target,
+	}
+
+	if msg.ReceivedAt != nil {
+		pbMsg.ReceivedAt = timestamppb.New(*msg.ReceivedAt)
+	}
+
+	if msg.Thread != nil {
+		pbMsg.Thread = &chatpb.ThreadSummary{
+			ReplyCount:      int64(msg.Thread.ReplyCount),
+			LastReplyId:     msg.Thread.LastReplyId,
+			LastReplySender: msg.Thread.LastReplySender,
+			LastReplyAt:     timestamppb.New(msg.Thread.LastReplyAt),
+		}
+	}
+
+	return pbMsg
+}
+
+// MessageFromProto converts the protobuf representation of a message to a Message
+func MessageFromProto(pbMsg *chatpb.Message) Message {
+	msg := Message{
+		Id:        pbMsg.GetId(),
+		Type:      pbMsg.GetType(),
+		MessageId: pbMsg.GetMessageId(),
+		Text:      pbMsg.GetText(),
+		Sender:    pbMsg.GetSender(),
+		SentAt:    pbMsg.GetSentAt().AsTime(),
+		Room:      pbMsg.GetRoom(),
+		ParentId:  pbMsg.GetParentId(),
+		Target:    pbMsg.GetTarget(),
+	}
+
+	if pbMsg.ReceivedAt != nil {
+		receivedAt := pbMsg.ReceivedAt.AsTime()
+		msg.ReceivedAt = &receivedAt
+	}
+
+	if pbMsg.Thread != nil {
+		msg.Thread = &ThreadSummary{
+			ReplyCount:      int(pbMsg.Thread.GetReplyCount()),
+			LastReplyId:     pbMsg.Thread.GetLastReplyId(),
+			LastReplySender: pbMsg.Thread.GetLastReplySender(),
+			LastReplyAt:     pbMsg.Thread.GetLastReplyAt().AsTime(),
+		}
+	}
+
+	return msg
+}
@@ -1,17 +1,78 @@
 package chat
 
 import (
+	"bytes"
 	"encoding/json"
 	"log"
 	"time"
 )
 
+// SystemMessage is the type of messages that are created by the server, e.g. announcements
+const SystemMessage = "system"
+
+// Types of messages that clients send to act on a room instead of chatting.
+// The affected message or user is referenced by the message's target.
+const (
+	// EditMessage replaces the text of the target message
+	EditMessage = "edit"
+	// DeleteMessage deletes the target message
+	DeleteMessage = "delete"
+	// KickMessage disconnects the target user from the room
+	KickMessage = "kick"
+	// TopicMessage changes the topic of the room to the message's text
+	TopicMessage = "topic"
+)
+
+// ThreadMessage is sent by the server when the summary of a thread changed. The target is the id of the thread's
+// parent message and the thread holds the new summary.
+const ThreadMessage = "thread"
+
+// Types of frames that add rooms to a connection or remove them. The room is the message's room,
+// the password of a protected room is the message's text. The server confirms a subscription change
+// by sending a message of the same type and room back to the client.
+const (
+	SubscribeMessage   = "subscribe"
+	UnsubscribeMessage = "unsubscribe"
+)
+
+// IsClientType indicates whether clients are allowed to send messages of the supplied type
+func IsClientType(messageType string) bool {
+	switch messageType {
+	case "", EditMessage, DeleteMessage, KickMessage, TopicMessage:
+		return true
+	}
+	return false
+}
+
+// AllRooms is the room of system messages that are sent to the clients of all rooms
+const AllRooms = "*"
+
 type Message struct {
+	// Id is assigned by the server when it receives the message
+	Id string `json:"id,omitempty"`
+	// Type is empty for chat messages
+	Type      string    `json:"type,omitempty"`
 	MessageId uint64    `json:"message_id"`
 	Text      string    `json:"text"`
 	Sender    string    `json:"sender"`
 	SentAt    time.Time `json:"sent_at"`
 	Room      string    `json:"room"`
+	// ParentId is the server assigned id of the message this message replies to
+	ParentId string `json:"parent_id,omitempty"`
+	// Thread summarizes the replies of a message that started a thread
+	Thread *ThreadSummary `json:"thread,omitempty"`
+	// Target is the id of the message or the identity of the user an action refers to
+	Target string `json:"target,omitempty"`
+	// ReceivedAt is the time the server received the message, it is only set if the server is configured to add it
+	ReceivedAt *time.Time `json:"received_at,omitempty"`
+}
+
+// ThreadSummary holds the reply statistics of a thread's parent message
+type ThreadSummary struct {
+	ReplyCount      int       `json:"reply_count"`
+	LastReplyId     string    `json:"last_reply_id"`
+	LastReplySender string    `json:"last_reply_sender"`
+	LastReplyAt     time.Time `json:"last_reply_at"`
 }
 
 // UnmarshalBinary a given byte array to a Message
@@ -33,3 +94,31 @@ func (msg *Message) MarshalBinary() ([]byte, error) {
 	}
 	return data, nil
 }
+
+// BatchQuery is the query parameter websocket clients set to true to receive several JSON messages per frame
+const BatchQuery = "batch"
+
+// MarshalBatch encodes several messages as a JSON array, which is sent as a single frame
+func MarshalBatch(messages []*Message) ([]byte, error) {
+	return json.Marshal(messages)
+}
+
+// UnmarshalBatch decodes a frame that contains either a single JSON message or a JSON array of messages
+func UnmarshalBatch(data []byte) ([]*Message, error) {
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var messages []*Message
+		err := json.Unmarshal(trimmed, &messages)
+		if err != nil {
+			log.Printf("Cannot parse message batch: %v", err)
+			return nil, err
+		}
+		return messages, nil
+	}
+
+	var message Message
+	err := message.UnmarshalBinary(data)
+	if err != nil {
+		return nil, err
+	}
+	return []*Message{&message}, nil
+}
@@ -0,0 +1,4 @@
+// Package chatpb contains the protobuf types and the gRPC service of the chat protocol.
+package chatpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative message.proto chat.proto
@@ -4,7 +4,6 @@ import (
 	"bufio"
 	"context"
 	"github.com/google/uuid"
-	"github.com/gorilla/websocket"
 	"log"
 	"os"
 	"scale-chat/chat"
@@ -18,7 +17,7 @@ var consoleReader = bufio.NewReader(os.Stdin)
 type Client struct {
 	Context          context.Context
 	WaitGroup        *sync.WaitGroup
-	wsConnection     websocket.Conn
+	connection       connection
 	id               string
 	CloseConnection  chan os.Signal
 	ServerUrl        string
@@ -27,6 +26,22 @@ type Client struct {
 	MsgFrequency     int
 	MsgEvents        chan<- *MessageEventEntry
 	Room             string
+	// Thread subscribes the client to a single thread of the room if it is set
+	Thread string
+	// Encoding is the name of the codec that will be negotiated with the server, defaults to JSON
+	Encoding string
+	// Compression enables the permessage-deflate extension if the server supports it
+	Compression bool
+	// Password is sent when joining password-protected rooms
+	Password string
+	// Subscriptions are further rooms the client receives messages of, it sends its own messages to Room only
+	Subscriptions []string
+	// Batch asks the server to send queued messages as a single JSON array frame, which requires the JSON encoding
+	Batch bool
+	// Idle clients only receive messages and never send any, which is used to measure the cost of idle connections
+	Idle bool
+	// writeMutex serializes the writes of the send handler and the subscription frames
+	writeMutex sync.Mutex
 }
 
 func (client *Client) Start() error {
@@ -56,12 +71,19 @@ func (client *Client) Start() error {
 	}
 
 	// Connection Establishment
-	wsConnection, _, err := websocket.DefaultDialer.Dial(client.ServerUrl+"/"+client.Room, nil)
+	conn, err := client.dial()
 	if err != nil {
-		log.Fatal("Error connecting to Websocket Server:", err)
+		log.Fatal("Error connecting to the server:", err)
 	}
 
-	client.wsConnection = *wsConnection
+	client.connection = conn
+
+	for _, room := range client.Subscriptions {
+		err = client.Subscribe(room, "")
+		if err != nil {
+			log.Fatal("Error subscribing to room:", err)
+		}
+	}
 
 	waitGroup := &sync.WaitGroup{}
 	waitGroup.Add(2)
@@ -85,17 +107,8 @@ func (client *Client) Start() error {
 	waitGroup.Wait()
 
 	// Closing the connection gracefully
-	err = wsConnection.WriteMessage(
-		websocket.CloseMessage,
-		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
-	if err != nil {
-		log.Println("Error while closing the ws connection gracefully: ", err)
-		return err
-	}
-
-	err = wsConnection.Close()
+	err = conn.Close()
 	if err != nil {
-		log.Println("Cannot close websocket connection", err)
 		return err
 	}
 
@@ -106,18 +119,18 @@ func (client *Client) Start() error {
 func (client *Client) receiveHandler(ctx context.Context, waitGroup *sync.WaitGroup) {
 	defer waitGroup.Done()
 
-	incomingMessages := make(chan *[]byte)
+	incomingMessages := make(chan *chat.Message)
 
 	// Convert blocking ReadMessage call into channel
 	go func() {
 		for {
-			_, data, err := client.wsConnection.ReadMessage()
+			message, err := client.connection.ReadMessage()
 			if err != nil {
 				close(incomingMessages)
 				return
 			}
 
-			incomingMessages <- &data
+			incomingMessages <- message
 		}
 	}()
 
@@ -125,7 +138,7 @@ func (client *Client) receiveHandler(ctx context.Context, waitGroup *sync.WaitGr
 		select {
 		case <-ctx.Done():
 			return
-		case data, ok := <-incomingMessages:
+		case message, ok := <-incomingMessages:
 			if !ok {
 				log.Println("incomingMessages channel was closed")
 				return
@@ -133,9 +146,17 @@ func (client *Client) receiveHandler(ctx context.Context, waitGroup *sync.WaitGr
 
 			receivedAt := time.Now()
 
-			var message chat.Message
-			err := message.UnmarshalBinary(*data)
-			if err != nil {
+			switch message.Type {
+			case chat.SubscribeMessage:
+				log.Printf("Subscribed to room %v", message.Room)
+				continue
+			case chat.UnsubscribeMessage:
+				log.Printf("Unsubscribed from room %v %v", message.Room, message.Text)
+				continue
+			case chat.ThreadMessage:
+				if message.Thread != nil {
+					log.Printf("[%v] Thread %v has %v replies", message.Room, message.Target, message.Thread.ReplyCount)
+				}
 				continue
 			}
 
@@ -151,7 +172,7 @@ func (client *Client) receiveHandler(ctx context.Context, waitGroup *sync.WaitGr
 				client.MsgEvents <- &msgEventEntry
 			}
 
-			log.Printf("%v", message)
+			log.Printf("[%v] %v", message.Room, message)
 		}
 	}
 }
@@ -160,6 +181,11 @@ func (client *Client) receiveHandler(ctx context.Context, waitGroup *sync.WaitGr
 func (client *Client) sendHandler(ctx context.Context, waitGroup *sync.WaitGroup) {
 	defer waitGroup.Done()
 
+	if client.Idle {
+		<-ctx.Done()
+		return
+	}
+
 	// Each message has an id to be able to follow the message in the message flow.
 	var messageId uint64 = 1
 
@@ -193,14 +219,9 @@ func (client *Client) sendHandler(ctx context.Context, waitGroup *sync.WaitGroup
 				Room:      client.Room,
 			}
 
-			data, err := message.MarshalBinary()
-			if err != nil {
-				continue
-			}
-
 			ts := time.Now()
 
-			err = client.wsConnection.WriteMessage(websocket.TextMessage, data)
+			err := client.write(&message)
 			if err != nil {
 				log.Println("Error while sending message:", err)
 				return
@@ -221,3 +242,21 @@ func (client *Client) sendHandler(ctx context.Context, waitGroup *sync.WaitGroup
 		}
 	}
 }
+
+// Subscribe asks the server to send the messages of another room to this connection as well.
+// The password is only required for password-protected rooms. The server confirms the subscription asynchronously.
+func (client *Client) Subscribe(room string, password string) error {
+	return client.write(&chat.Message{Type: chat.SubscribeMessage, Room: room, Text: password, Sender: client.id, SentAt: time.Now()})
+}
+
+// Unsubscribe asks the server to stop sending the messages of a room to this connection
+func (client *Client) Unsubscribe(room string) error {
+	return client.write(&chat.Message{Type: chat.UnsubscribeMessage, Room: room, Sender: client.id, SentAt: time.Now()})
+}
+
+// write sends a message, connections do not support concurrent writes
+func (client *Client) write(message *chat.Message) error {
+	client.writeMutex.Lock()
+	defer client.writeMutex.Unlock()
+	return client.connection.WriteMessage(message)
+}
@@ -0,0 +1,300 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"github.com/gorilla/websocket"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"scale-chat/chat"
+	"scale-chat/chatpb"
+	"time"
+)
+
+// connection is the transport the client uses to exchange messages with the server
+type connection interface {
+	// ReadMessage blocks until the next message arrives, messages that cannot be decoded are skipped
+	ReadMessage() (*chat.Message, error)
+	WriteMessage(message *chat.Message) error
+	// Close closes the connection gracefully
+	Close() error
+}
+
+// dial connects to the server. Server urls with the tcp scheme use the line protocol of the TCP gateway,
+// urls with the grpc scheme use the gRPC Chat stream, all other urls are websocket endpoints.
+func (client *Client) dial() (connection, error) {
+	serverUrl, err := url.Parse(client.ServerUrl)
+	if err != nil {
+		return nil, err
+	}
+
+	if serverUrl.Scheme == "tcp" {
+		return dialTCP(serverUrl.Host, client.Room, client.Password)
+	}
+
+	if serverUrl.Scheme == "grpc" {
+		return dialGRPC(serverUrl.Host, client.Room, client.Thread, client.id, client.Password)
+	}
+
+	return client.dialWebsocket()
+}
+
+// websocketConnection exchanges messages encoded with the negotiated codec via websocket
+type websocketConnection struct {
+	wsConn      *websocket.Conn
+	codec       chat.Codec
+	messageType int
+	// batch indicates whether the server sends array frames, pending holds the remaining messages of the last one
+	batch   bool
+	pending []*chat.Message
+}
+
+// dialWebsocket connects to the room's websocket endpoint and negotiates the codec and compression
+func (client *Client) dialWebsocket() (connection, error) {
+	query := url.Values{}
+	query.Set("name", client.id)
+	if client.Thread != "" {
+		query.Set("thread", client.Thread)
+	}
+	if client.Batch {
+		query.Set(chat.BatchQuery, "true")
+	}
+	endpoint := client.ServerUrl + "/" + client.Room + "?" + query.Encode()
+
+	codec := chat.Codecs[0]
+	if client.Encoding != "" {
+		var ok bool
+		codec, ok = chat.CodecByName(client.Encoding)
+		if !ok {
+			return nil, fmt.Errorf("unknown encoding: %v", client.Encoding)
+		}
+	}
+
+	dialer := *websocket.DefaultDialer
+	dialer.Subprotocols = []string{chat.Subprotocol(codec)}
+	dialer.EnableCompression = client.Compression
+
+	header := http.Header{}
+	if client.Password != "" {
+		header.Set("X-Room-Password", client.Password)
+	}
+
+	wsConn, _, err := dialer.Dial(endpoint, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if wsConn.Subprotocol() != chat.Subprotocol(codec) {
+		_ = wsConn.Close()
+		return nil, fmt.Errorf("server does not support the %v encoding", codec.Name())
+	}
+
+	messageType := websocket.TextMessage
+	if codec.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+
+	batch := client.Batch && !codec.Binary()
+
+	return &websocketConnection{wsConn: wsConn, codec: codec, messageType: messageType, batch: batch}, nil
+}
+
+func (conn *websocketConnection) ReadMessage() (*chat.Message, error) {
+	for {
+		if len(conn.pending) > 0 {
+			message := conn.pending[0]
+			conn.pending = conn.pending[1:]
+			return message, nil
+		}
+
+		_, data, err := conn.wsConn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		if conn.batch {
+			conn.pending, _ = chat.UnmarshalBatch(data)
+			continue
+		}
+
+		var message chat.Message
+		err = conn.codec.Unmarshal(data, &message)
+		if err != nil {
+			continue
+		}
+
+		return &message, nil
+	}
+}
+
+func (conn *websocketConnection) WriteMessage(message *chat.Message) error {
+	data, err := conn.codec.Marshal(message)
+	if err != nil {
+		return err
+	}
+
+	return conn.wsConn.WriteMessage(conn.messageType, data)
+}
+
+// Close sends a close frame before closing the websocket connection
+func (conn *websocketConnection) Close() error {
+	err := conn.wsConn.WriteMessage(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		log.Println("Error while closing the ws connection gracefully: ", err)
+		return err
+	}
+
+	err = conn.wsConn.Close()
+	if err != nil {
+		log.Println("Cannot close websocket connection", err)
+		return err
+	}
+
+	return nil
+}
+
+// tcpConnection exchanges newline-delimited JSON encoded messages with the TCP gateway
+type tcpConnection struct {
+	netConn net.Conn
+	scanner *bufio.Scanner
+}
+
+// dialTCP connects to the TCP gateway and selects the room
+func dialTCP(address string, room string, password string) (connection, error) {
+	netConn, err := net.DialTimeout("tcp", address, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	selection := room
+	if password != "" {
+		selection += " " + password
+	}
+
+	_, err = netConn.Write([]byte(selection + "\n"))
+	if err != nil {
+		_ = netConn.Close()
+		return nil, err
+	}
+
+	scanner := bufio.NewScanner(netConn)
+	scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+
+	return &tcpConnection{netConn: netConn, scanner: scanner}, nil
+}
+
+func (conn *tcpConnection) ReadMessage() (*chat.Message, error) {
+	for conn.scanner.Scan() {
+		var message chat.Message
+		err := message.UnmarshalBinary(conn.scanner.Bytes())
+		if err != nil {
+			continue
+		}
+
+		return &message, nil
+	}
+
+	err := conn.scanner.Err()
+	if err == nil {
+		err = net.ErrClosed
+	}
+	return nil, err
+}
+
+func (conn *tcpConnection) WriteMessage(message *chat.Message) error {
+	data, err := message.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.netConn.Write(append(data, '\n'))
+	return err
+}
+
+func (conn *tcpConnection) Close() error {
+	err := conn.netConn.Close()
+	if err != nil {
+		log.Println("Cannot close TCP connection", err)
+		return err
+	}
+	return nil
+}
+
+// grpcConnection exchanges messages via the bidirectional stream of the gRPC Chat service
+type grpcConnection struct {
+	clientConn *grpc.ClientConn
+	stream     chatpb.Chat_ChatClient
+	cancel     context.CancelFunc
+}
+
+// DialGRPC connects to the gRPC Chat service of the server. The returned stub can be used to send messages
+// and to read the history without joining a room.
+func DialGRPC(address string) (*grpc.ClientConn, chatpb.ChatClient, error) {
+	clientConn, err := grpc.Dial(address, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, nil, err
+	}
+	return clientConn, chatpb.NewChatClient(clientConn), nil
+}
+
+// dialGRPC opens a Chat stream and joins the room
+func dialGRPC(address string, room string, thread string, identity string, password string) (connection, error) {
+	clientConn, chatClient, err := DialGRPC(address)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := chatClient.Chat(ctx)
+	if err != nil {
+		cancel()
+		_ = clientConn.Close()
+		return nil, err
+	}
+
+	err = stream.Send(&chatpb.ChatRequest{Room: room, Thread: thread, Identity: identity, Password: password})
+	if err != nil {
+		cancel()
+		_ = clientConn.Close()
+		return nil, err
+	}
+
+	return &grpcConnection{clientConn: clientConn, stream: stream, cancel: cancel}, nil
+}
+
+func (conn *grpcConnection) ReadMessage() (*chat.Message, error) {
+	pbMsg, err := conn.stream.Recv()
+	if err != nil {
+		return nil, err
+	}
+
+	message := chat.MessageFromProto(pbMsg)
+	return &message, nil
+}
+
+func (conn *grpcConnection) WriteMessage(message *chat.Message) error {
+	return conn.stream.Send(&chatpb.ChatRequest{Message: message.ToProto()})
+}
+
+// Close ends the stream and closes the underlying connection
+func (conn *grpcConnection) Close() error {
+	err := conn.stream.CloseSend()
+	conn.cancel()
+	if err != nil {
+		log.Println("Error while closing the gRPC stream gracefully: ", err)
+	}
+
+	err = conn.clientConn.Close()
+	if err != nil {
+		log.Println("Cannot close gRPC connection", err)
+		return err
+	}
+	return nil
+}
@@ -19,7 +19,7 @@ func main() {
 		"Flag indicates weather the client should start in the load test mode")
 
 	serverUrl := flag.String("server-url", "ws://localhost:8080/ws",
-		"The url of the server to connect to")
+		"The url of the server to connect to, use tcp://host:port to connect to the TCP gateway")
 
 	msgFrequency := flag.Int("msg-frequency", 1000,
 		"The frequency of the messages in ms (just for load test mode")
@@ -33,6 +33,24 @@ func main() {
 	roomSize := flag.Int("room-size", 1,
 		"Number of clients that will be started per room (just for load test mode")
 
+	encoding := flag.String("encoding", "json",
+		"The encoding of the messages that will be negotiated with the server: json, msgpack or protobuf")
+
+	compression := flag.Bool("compression", false,
+		"Flag indicates whether the clients should negotiate permessage-deflate compression with the server")
+
+	subscriptions := flag.Int("subscriptions", 0,
+		"Number of further rooms every client subscribes to, the clients receive their messages but only send to their own room (just for load test mode)")
+
+	password := flag.String("password", "",
+		"The password of the rooms, which is required if they are password-protected")
+
+	batch := flag.Bool("batch", false,
+		"Flag indicates whether the clients ask the server to send queued messages as JSON array frames")
+
+	idle := flag.Bool("idle", false,
+		"Flag indicates whether the clients only connect and receive messages without sending any (just for load test mode)")
+
 	flag.Parse()
 
 	var msgEvents chan *client.MessageEventEntry
@@ -61,9 +79,20 @@ func main() {
 		csvWriterWaitGroup.Add(1)
 	}
 
+	rooms := make([]string, *numOfRooms)
+	for i := range rooms {
+		rooms[i] = uuid.New().String()
+	}
+
 	// Create rooms
-	for i := 0; i < *numOfRooms; i++ {
-		room := uuid.New().String()
+	for i := range rooms {
+		room := rooms[i]
+
+		// Subscribe to the following rooms, so every room gets the same number of subscribers
+		var roomSubscriptions []string
+		for k := 1; k <= *subscriptions && k < len(rooms); k++ {
+			roomSubscriptions = append(roomSubscriptions, rooms[(i+k)%len(rooms)])
+		}
 
 		// Create clients per room
 		for j := 1; j <= *roomSize; j++ {
@@ -87,6 +116,12 @@ func main() {
 					MsgSize:          *msgSize,
 					MsgEvents:        msgEvents,
 					Room:             room,
+					Encoding:         *encoding,
+					Compression:      *compression,
+					Password:         *password,
+					Subscriptions:    roomSubscriptions,
+					Idle:             *idle,
+					Batch:            *batch,
 				}
 
 				err := chatClient.Start()
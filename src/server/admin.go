@@ -0,0 +1,578 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"scale-chat/chat"
+	"sort"
+	"strings"
+	"time"
+)
+
+// RoomInfo describes a room that has clients connected to this server
+type RoomInfo struct {
+	Room    string `json:"room"`
+	Members int    `json:"members"`
+}
+
+// KickRequest is the request body of the kick endpoint
+type KickRequest struct {
+	Reason string `json:"reason"`
+}
+
+// AnnouncementRequest is the request body of the announcement endpoint.
+// If no room is supplied, the announcement is sent to all rooms.
+type AnnouncementRequest struct {
+	Room string `json:"room"`
+	Text string `json:"text"`
+}
+
+// SanctionRequest is the request body of the sanctions endpoint.
+// The duration is a Go duration like "24h", sanctions without duration are permanent.
+type SanctionRequest struct {
+	Kind     string `json:"kind"`
+	Identity string `json:"identity"`
+	IP       string `json:"ip"`
+	Room     string `json:"room"`
+	Reason   string `json:"reason"`
+	Duration string `json:"duration"`
+}
+
+// RoomSettingsRequest is the request body of the room settings endpoint, missing fields are not changed.
+// Password-protected rooms require a password.
+type RoomSettingsRequest struct {
+	Topic       *string `json:"topic"`
+	Access      *Access `json:"access"`
+	Password    *string `json:"password"`
+	DefaultRole *Role   `json:"default_role"`
+}
+
+// RoleRequest is the request body of the role endpoint
+type RoleRequest struct {
+	Role Role `json:"role"`
+}
+
+// WebhookRequest is the request body of the webhooks endpoint. Webhooks without room receive the events of all rooms.
+// A random secret is generated if none is supplied.
+type WebhookRequest struct {
+	Url    string   `json:"url"`
+	Room   string   `json:"room"`
+	Secret string   `json:"secret"`
+	Events []string `json:"events"`
+}
+
+// WebhookInfo describes a registered webhook
+type WebhookInfo struct {
+	Webhook
+	Room string `json:"room"`
+}
+
+// PublishTokenRequest is the request body of the publish tokens endpoint
+type PublishTokenRequest struct {
+	// Name describes the service that uses the token, it is the default sender of its messages
+	Name string `json:"name"`
+}
+
+// PublishTokenResponse contains the token value, which is only returned when the token is created
+type PublishTokenResponse struct {
+	PublishToken
+	Token string `json:"token"`
+}
+
+// IdentityTokenResponse contains the identity token of a user
+type IdentityTokenResponse struct {
+	Identity string `json:"identity"`
+	Token    string `json:"token"`
+}
+
+// InviteResponse contains the room's settings and the invite token, which is only returned when the user is invited
+type InviteResponse struct {
+	RoomSettings
+	Token string `json:"invite_token"`
+}
+
+// RegisterAdminHandlers registers the admin endpoints on the internal router.
+// All endpoints require the supplied token as bearer token.
+func RegisterAdminHandlers(router *mux.Router, token string) {
+	admin := router.PathPrefix("/admin").Subrouter()
+	admin.Use(requireToken(token))
+
+	admin.HandleFunc("/rooms", listRoomsHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/rooms/{room}", closeRoomHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/rooms/{room}/settings", roomSettingsHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/rooms/{room}/settings", updateRoomSettingsHandler).Methods(http.MethodPatch)
+	admin.HandleFunc("/rooms/{room}/roles/{identity}", setRoleHandler).Methods(http.MethodPut)
+	admin.HandleFunc("/rooms/{room}/roles/{identity}", removeRoleHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/rooms/{room}/invites/{identity}", inviteHandler).Methods(http.MethodPut)
+	admin.HandleFunc("/rooms/{room}/invites/{identity}", uninviteHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/rooms/{room}/tokens", addPublishTokenHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/rooms/{room}/tokens/{id}", removePublishTokenHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/identities/{identity}/token", identityTokenHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/connections", listConnectionsHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/connections/{id}/kick", kickHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/announcements", announcementHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/sanctions", listSanctionsHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/sanctions", addSanctionHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/sanctions/{id}", revokeSanctionHandler).Methods(http.MethodDelete)
+	admin.HandleFunc("/spam", listSpamHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/webhooks", listWebhooksHandler).Methods(http.MethodGet)
+	admin.HandleFunc("/webhooks", addWebhookHandler).Methods(http.MethodPost)
+	admin.HandleFunc("/webhooks/{id}", removeWebhookHandler).Methods(http.MethodDelete)
+}
+
+// requireToken rejects requests that do not carry the token as bearer token
+func requireToken(token string) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+			supplied := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(supplied), []byte(token)) != 1 {
+				http.Error(writer, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(writer, req)
+		})
+	}
+}
+
+// Handles GET /admin/rooms and lists the rooms with their number of members
+func listRoomsHandler(writer http.ResponseWriter, _ *http.Request) {
+	members := make(map[string]int)
+	for _, client := range ActiveClients() {
+		for _, room := range client.Rooms() {
+			members[room]++
+		}
+	}
+
+	rooms := make([]RoomInfo, 0, len(members))
+	for room, count := range members {
+		rooms = append(rooms, RoomInfo{Room: room, Members: count})
+	}
+	sort.Slice(rooms, func(i, j int) bool {
+		return rooms[i].Room < rooms[j].Room
+	})
+
+	writeJSON(writer, http.StatusOK, rooms)
+}
+
+// Handles GET /admin/connections and lists the connected clients
+func listConnectionsHandler(writer http.ResponseWriter, _ *http.Request) {
+	connections := make([]ConnectionInfo, 0)
+	for _, client := range ActiveClients() {
+		connections = append(connections, client.Info())
+	}
+
+	writeJSON(writer, http.StatusOK, connections)
+}
+
+// Handles POST /admin/connections/{id}/kick and disconnects a client
+func kickHandler(writer http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+
+	var request KickRequest
+	if !decodeOptionalJSON(writer, req, &request) {
+		return
+	}
+	if request.Reason == "" {
+		request.Reason = "You were kicked by an administrator"
+	}
+
+	for _, client := range ActiveClients() {
+		if client.id == id {
+			log.Printf("Kicking client %v: %v", id, request.Reason)
+			client.Kick(request.Reason)
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	http.Error(writer, "connection not found", http.StatusNotFound)
+}
+
+// Handles DELETE /admin/rooms/{room} and removes all clients of the room that are connected to this server
+func closeRoomHandler(writer http.ResponseWriter, req *http.Request) {
+	room := mux.Vars(req)["room"]
+
+	log.Println("Closing room:", room)
+
+	for _, client := range ActiveClients() {
+		client.Remove(room, "The room was closed by an administrator")
+	}
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// Handles GET /admin/rooms/{room}/settings and returns a room's settings including the invitations
+func roomSettingsHandler(writer http.ResponseWriter, req *http.Request) {
+	settings := rooms.Get(mux.Vars(req)["room"])
+	writeJSON(writer, http.StatusOK, settings.Redacted())
+}
+
+// Handles PATCH /admin/rooms/{room}/settings and changes the topic or the default role of a room
+func updateRoomSettingsHandler(writer http.ResponseWriter, req *http.Request) {
+	room := mux.Vars(req)["room"]
+
+	var request RoomSettingsRequest
+	err := json.NewDecoder(http.MaxBytesReader(writer, req.Body, maxMessageBodySize)).Decode(&request)
+	if err != nil {
+		http.Error(writer, "invalid room settings", http.StatusBadRequest)
+		return
+	}
+
+	if request.DefaultRole != nil && !request.DefaultRole.Valid() {
+		http.Error(writer, "unknown role", http.StatusBadRequest)
+		return
+	}
+
+	if request.Access != nil && !request.Access.Valid() {
+		http.Error(writer, "unknown access policy", http.StatusBadRequest)
+		return
+	}
+
+	current := rooms.Get(room)
+	if request.Access != nil && *request.Access == AccessPassword && request.Password == nil && current.PasswordHash == "" {
+		http.Error(writer, "password-protected rooms require a password", http.StatusBadRequest)
+		return
+	}
+
+	settings := rooms.Update(room, func(settings *RoomSettings) {
+		if request.Topic != nil {
+			settings.Topic = *request.Topic
+		}
+		if request.Access != nil {
+			settings.Access = *request.Access
+		}
+		if request.Password != nil {
+			settings.SetPassword(*request.Password)
+		}
+		if request.DefaultRole != nil {
+			settings.DefaultRole = *request.DefaultRole
+		}
+	})
+
+	writeJSON(writer, http.StatusOK, settings.Redacted())
+}
+
+// Handles PUT /admin/rooms/{room}/roles/{identity} and assigns a role to a user
+func setRoleHandler(writer http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	var request RoleRequest
+	err := json.NewDecoder(http.MaxBytesReader(writer, req.Body, maxMessageBodySize)).Decode(&request)
+	if err != nil || !request.Role.Valid() {
+		http.Error(writer, "invalid role", http.StatusBadRequest)
+		return
+	}
+
+	settings := rooms.Update(vars["room"], func(settings *RoomSettings) {
+		settings.Roles[vars["identity"]] = request.Role
+	})
+
+	log.Printf("%v is %v of room %v", vars["identity"], request.Role, vars["room"])
+
+	writeJSON(writer, http.StatusOK, settings.Redacted())
+}
+
+// Handles DELETE /admin/rooms/{room}/roles/{identity} and resets a user to the room's default role
+func removeRoleHandler(writer http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	settings := rooms.Update(vars["room"], func(settings *RoomSettings) {
+		delete(settings.Roles, vars["identity"])
+	})
+
+	writeJSON(writer, http.StatusOK, settings.Redacted())
+}
+
+// Handles PUT /admin/rooms/{room}/invites/{identity} and allows a user to join an invite-only room.
+// A new invite token replaces the previous one of the user.
+func inviteHandler(writer http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	var token string
+	settings := rooms.Update(vars["room"], func(settings *RoomSettings) {
+		token = settings.Invite(vars["identity"])
+	})
+
+	writeJSON(writer, http.StatusOK, InviteResponse{RoomSettings: settings.Redacted(), Token: token})
+}
+
+// Handles DELETE /admin/rooms/{room}/invites/{identity} and withdraws an invitation
+func uninviteHandler(writer http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	settings := rooms.Update(vars["room"], func(settings *RoomSettings) {
+		invited := settings.Invited[:0]
+		for _, identity := range settings.Invited {
+			if identity != vars["identity"] {
+				invited = append(invited, identity)
+			}
+		}
+		settings.Invited = invited
+		delete(settings.InviteHashes, vars["identity"])
+	})
+
+	writeJSON(writer, http.StatusOK, settings.Redacted())
+}
+
+// Handles POST /admin/rooms/{room}/tokens and creates a token for the room's messages endpoint
+func addPublishTokenHandler(writer http.ResponseWriter, req *http.Request) {
+	room := mux.Vars(req)["room"]
+
+	var request PublishTokenRequest
+	err := json.NewDecoder(http.MaxBytesReader(writer, req.Body, maxMessageBodySize)).Decode(&request)
+	if err != nil || request.Name == "" {
+		http.Error(writer, "the token requires a name", http.StatusBadRequest)
+		return
+	}
+
+	publishToken, token := NewPublishToken(request.Name)
+	rooms.Update(room, func(settings *RoomSettings) {
+		settings.PublishTokens = append(settings.PublishTokens, publishToken)
+	})
+
+	log.Printf("Created publish token %v for room %v", publishToken.Id, room)
+
+	publishToken.Hash = ""
+	writeJSON(writer, http.StatusCreated, PublishTokenResponse{PublishToken: publishToken, Token: token})
+}
+
+// Handles POST /admin/identities/{identity}/token and signs a token that lets the user claim the identity
+func identityTokenHandler(writer http.ResponseWriter, req *http.Request) {
+	identity := mux.Vars(req)["identity"]
+
+	token, err := NewIdentityToken(identity)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	writeJSON(writer, http.StatusCreated, IdentityTokenResponse{Identity: identity, Token: token})
+}
+
+// Handles DELETE /admin/rooms/{room}/tokens/{id} and revokes a publish token
+func removePublishTokenHandler(writer http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	settings := rooms.Get(vars["room"])
+	for _, publishToken := range settings.PublishTokens {
+		if publishToken.Id != vars["id"] {
+			continue
+		}
+
+		rooms.Update(vars["room"], func(settings *RoomSettings) {
+			remaining := make([]PublishToken, 0, len(settings.PublishTokens))
+			for _, publishToken := range settings.PublishTokens {
+				if publishToken.Id != vars["id"] {
+					remaining = append(remaining, publishToken)
+				}
+			}
+			settings.PublishTokens = remaining
+		})
+
+		writer.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	http.Error(writer, "token not found", http.StatusNotFound)
+}
+
+// Handles POST /admin/announcements and sends a system message to one or all rooms
+func announcementHandler(writer http.ResponseWriter, req *http.Request) {
+	var request AnnouncementRequest
+	err := json.NewDecoder(http.MaxBytesReader(writer, req.Body, maxMessageBodySize)).Decode(&request)
+	if err != nil || request.Text == "" {
+		http.Error(writer, "invalid announcement", http.StatusBadRequest)
+		return
+	}
+
+	room := request.Room
+	if room == "" {
+		room = chat.AllRooms
+	}
+
+	message := NewSystemMessage(room, request.Text)
+	SubmitSystemMessage(message, incoming)
+
+	writeJSON(writer, http.StatusAccepted, SendResponse{Id: message.Id})
+}
+
+// Handles GET /admin/sanctions and lists the bans and mutes that are in effect
+func listSanctionsHandler(writer http.ResponseWriter, _ *http.Request) {
+	writeJSON(writer, http.StatusOK, moderation.List())
+}
+
+// Handles POST /admin/sanctions and bans or mutes a user by identity or IP address
+func addSanctionHandler(writer http.ResponseWriter, req *http.Request) {
+	var request SanctionRequest
+	err := json.NewDecoder(http.MaxBytesReader(writer, req.Body, maxMessageBodySize)).Decode(&request)
+	if err != nil {
+		http.Error(writer, "invalid sanction", http.StatusBadRequest)
+		return
+	}
+
+	if request.Kind != BanSanction && request.Kind != MuteSanction {
+		http.Error(writer, "kind has to be ban or mute", http.StatusBadRequest)
+		return
+	}
+
+	if request.Identity == "" && request.IP == "" {
+		http.Error(writer, "identity or ip is required", http.StatusBadRequest)
+		return
+	}
+
+	// The addresses of the clients are normalized, so the sanction has to use the same notation to match them
+	if request.IP != "" {
+		ip := net.ParseIP(request.IP)
+		if ip == nil {
+			http.Error(writer, "invalid ip", http.StatusBadRequest)
+			return
+		}
+		request.IP = ip.String()
+	}
+
+	sanction := Sanction{
+		Kind:      request.Kind,
+		Identity:  request.Identity,
+		IP:        request.IP,
+		Room:      request.Room,
+		Reason:    request.Reason,
+		CreatedAt: time.Now(),
+	}
+
+	if request.Duration != "" {
+		duration, err := time.ParseDuration(request.Duration)
+		if err != nil || duration <= 0 {
+			http.Error(writer, "invalid duration", http.StatusBadRequest)
+			return
+		}
+		expiresAt := sanction.CreatedAt.Add(duration)
+		sanction.ExpiresAt = &expiresAt
+	}
+
+	sanction = moderation.Add(sanction)
+
+	log.Printf("Added %v sanction %v", sanction.Kind, sanction.Id)
+
+	writeJSON(writer, http.StatusCreated, sanction)
+}
+
+// Handles DELETE /admin/sanctions/{id} and lifts a ban or mute
+func revokeSanctionHandler(writer http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+
+	if !moderation.Revoke(id) {
+		http.Error(writer, "sanction not found", http.StatusNotFound)
+		return
+	}
+
+	log.Println("Revoked sanction", id)
+
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+// Handles GET /admin/spam and lists the latest messages that were flagged as spam
+func listSpamHandler(writer http.ResponseWriter, _ *http.Request) {
+	if spamDetector == nil {
+		writeJSON(writer, http.StatusOK, []SpamEvent{})
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, spamDetector.Events())
+}
+
+// Handles GET /admin/webhooks and lists the webhooks of all rooms without their secrets
+func listWebhooksHandler(writer http.ResponseWriter, _ *http.Request) {
+	list := make([]WebhookInfo, 0)
+	for _, settings := range rooms.List() {
+		for _, webhook := range settings.Webhooks {
+			webhook.Secret = ""
+			list = append(list, WebhookInfo{Webhook: webhook, Room: settings.Name})
+		}
+	}
+
+	writeJSON(writer, http.StatusOK, list)
+}
+
+// Handles POST /admin/webhooks and registers a webhook. The response is the only one that contains the secret.
+func addWebhookHandler(writer http.ResponseWriter, req *http.Request) {
+	var request WebhookRequest
+	err := json.NewDecoder(http.MaxBytesReader(writer, req.Body, maxMessageBodySize)).Decode(&request)
+	if err != nil {
+		http.Error(writer, "invalid webhook", http.StatusBadRequest)
+		return
+	}
+
+	target, err := url.Parse(request.Url)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		http.Error(writer, "invalid webhook url", http.StatusBadRequest)
+		return
+	}
+
+	for _, event := range request.Events {
+		if event != WebhookMessage && event != WebhookJoin && event != WebhookLeave {
+			http.Error(writer, "unknown event: "+event, http.StatusBadRequest)
+			return
+		}
+	}
+
+	room := request.Room
+	if room == "" {
+		room = chat.AllRooms
+	}
+
+	webhook := NewWebhook(request.Url, request.Secret, request.Events)
+	rooms.Update(room, func(settings *RoomSettings) {
+		settings.Webhooks = append(settings.Webhooks, webhook)
+	})
+
+	log.Printf("Registered webhook %v for room %v", webhook.Id, room)
+
+	writeJSON(writer, http.StatusCreated, WebhookInfo{Webhook: webhook, Room: room})
+}
+
+// Handles DELETE /admin/webhooks/{id} and removes a webhook
+func removeWebhookHandler(writer http.ResponseWriter, req *http.Request) {
+	id := mux.Vars(req)["id"]
+
+	for _, settings := range rooms.List() {
+		for _, webhook := range settings.Webhooks {
+			if webhook.Id != id {
+				continue
+			}
+
+			rooms.Update(settings.Name, func(settings *RoomSettings) {
+				remaining := make([]Webhook, 0, len(settings.Webhooks))
+				for _, webhook := range settings.Webhooks {
+					if webhook.Id != id {
+						remaining = append(remaining, webhook)
+					}
+				}
+				settings.Webhooks = remaining
+			})
+
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+	}
+
+	http.Error(writer, "webhook not found", http.StatusNotFound)
+}
+
+// decodeOptionalJSON decodes the request body if there is one and writes an error response if it is invalid
+func decodeOptionalJSON(writer http.ResponseWriter, req *http.Request, value interface{}) bool {
+	if req.ContentLength == 0 {
+		return true
+	}
+
+	err := json.NewDecoder(http.MaxBytesReader(writer, req.Body, maxMessageBodySize)).Decode(value)
+	if err != nil {
+		http.Error(writer, "invalid request body", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gorilla/mux"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"scale-chat/chat"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ThreadResponse is the response body of the thread endpoint
+type ThreadResponse struct {
+	Parent  *chat.Message  `json:"parent"`
+	Replies []chat.Message `json:"replies"`
+}
+
+// maxMessageBodySize is the maximum size of a message that is sent via HTTP
+const maxMessageBodySize = 1 << 20
+
+// SendResponse is the response body of the send endpoint, the id is empty if the message was not broadcast
+type SendResponse struct {
+	Id string `json:"id,omitempty"`
+}
+
+// sessionConn is implemented by the connections of clients that send their messages via the send endpoint
+type sessionConn interface {
+	// Session returns the id that identifies the connection in the requests of the send endpoint
+	Session() string
+}
+
+// sessionClients maps the session ids of SSE and long-polling connections to their clients
+var sessionClients = make(map[string]*Client)
+
+var sessionClientsMutex sync.RWMutex
+
+// addSession makes a client available to the send endpoint if its connection has a session
+func addSession(client *Client) {
+	if conn, ok := client.conn.(sessionConn); ok {
+		sessionClientsMutex.Lock()
+		sessionClients[conn.Session()] = client
+		sessionClientsMutex.Unlock()
+	}
+}
+
+// removeSession removes a client from the send endpoint
+func removeSession(client *Client) {
+	if conn, ok := client.conn.(sessionConn); ok {
+		sessionClientsMutex.Lock()
+		delete(sessionClients, conn.Session())
+		sessionClientsMutex.Unlock()
+	}
+}
+
+// Handles the /send endpoint, which is used by SSE and long-polling clients to send a message.
+// The message is handled like a message the client sent via a websocket connection, so the client has to pass
+// the id of its session. Rejections are sent to the client via its session.
+func sendHandler(writer http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	sessionClientsMutex.RLock()
+	client, ok := sessionClients[req.URL.Query().Get("session")]
+	sessionClientsMutex.RUnlock()
+
+	if !ok {
+		http.Error(writer, "session not found", http.StatusNotFound)
+		return
+	}
+
+	var message chat.Message
+	err := json.NewDecoder(http.MaxBytesReader(writer, req.Body, maxMessageBodySize)).Decode(&message)
+	if err != nil {
+		http.Error(writer, "invalid message", http.StatusBadRequest)
+		return
+	}
+
+	if room, ok := vars["room"]; ok {
+		message.Room = room
+	}
+	if message.SentAt.IsZero() {
+		message.SentAt = time.Now()
+	}
+
+	id := client.handleMessage(&message, incoming)
+
+	writeJSON(writer, http.StatusAccepted, SendResponse{Id: id})
+}
+
+// Handles the /api/rooms/{room}/threads/{id} endpoint and returns a thread's parent message and its replies
+func threadHandler(writer http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+
+	if rejectInaccessible(writer, req, vars["room"]) {
+		return
+	}
+
+	parent, replies, ok := history.Thread(vars["room"], vars["id"])
+	if !ok {
+		http.Error(writer, "thread not found", http.StatusNotFound)
+		return
+	}
+
+	writeJSON(writer, http.StatusOK, ThreadResponse{Parent: parent, Replies: replies})
+}
+
+// Handles POST /api/rooms/{room}/messages, which lets services that hold a publish token of the room post into it.
+// The message passes the middlewares and is distributed like messages of connected clients.
+func publishHandler(writer http.ResponseWriter, req *http.Request) {
+	room := mux.Vars(req)["room"]
+
+	settings := rooms.Get(room)
+	token, ok := settings.PublishToken(strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer "))
+	if !ok {
+		http.Error(writer, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var message chat.Message
+	err := json.NewDecoder(http.MaxBytesReader(writer, req.Body, maxMessageBodySize)).Decode(&message)
+	if err != nil || message.Text == "" {
+		http.Error(writer, "invalid message", http.StatusBadRequest)
+		return
+	}
+
+	message.Room = room
+	if message.Sender == "" {
+		message.Sender = token.Name
+	}
+	// Services cannot post in the name of users that hold a role
+	if err := claimIdentity(message.Sender, token.Name); err != nil {
+		http.Error(writer, err.Error(), http.StatusForbidden)
+		return
+	}
+	if message.SentAt.IsZero() {
+		message.SentAt = time.Now()
+	}
+	// Publish tokens only allow posting, actions like kicking require a role in the room
+	message.Type = ""
+	message.Target = ""
+
+	id, err := SubmitMessage(&MessageContext{Identity: message.Sender, IP: hostOf(remoteAddress(req)), Session: token.Name}, &message, incoming)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	writeJSON(writer, http.StatusCreated, SendResponse{Id: id})
+}
+
+// Handles the /api/rooms/{room} endpoint and returns a room's settings without its secrets
+func roomHandler(writer http.ResponseWriter, req *http.Request) {
+	settings := rooms.Get(mux.Vars(req)["room"])
+	redacted := settings.Redacted()
+	redacted.Invited = nil
+	redacted.Webhooks = nil
+	redacted.PublishTokens = nil
+
+	writeJSON(writer, http.StatusOK, redacted)
+}
+
+// trustedProxies are the networks of the reverse proxies whose X-Forwarded-For header is trusted
+var trustedProxies []*net.IPNet
+
+// initTrustedProxies reads the comma separated addresses or CIDR networks of the trusted reverse proxies
+// from TRUSTED_PROXIES
+func initTrustedProxies() {
+	trustedProxies = nil
+	for _, entry := range strings.Split(os.Getenv("TRUSTED_PROXIES"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				log.Printf("Cannot parse trusted proxy %v", entry)
+				continue
+			}
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			trustedProxies = append(trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Cannot parse trusted proxy %v: %v", entry, err)
+			continue
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+}
+
+// isTrustedProxy checks whether the address belongs to a trusted reverse proxy
+func isTrustedProxy(address string) bool {
+	ip := net.ParseIP(hostOf(address))
+	if ip == nil {
+		return false
+	}
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteAddress returns the address of the client that sent the request. The X-Forwarded-For header is only used
+// if the request was sent by a trusted reverse proxy like traefik, then the last address that does not belong
+// to a trusted proxy is the client, as the addresses before it might have been sent by the client itself.
+// Forwarded values that are no IP addresses are ignored, so clients cannot pick arbitrary keys for the per-IP limit.
+func remoteAddress(req *http.Request) string {
+	if !isTrustedProxy(req.RemoteAddr) {
+		return req.RemoteAddr
+	}
+
+	forwarded := strings.Split(strings.Join(req.Header.Values("X-Forwarded-For"), ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		address := strings.TrimSpace(forwarded[i])
+		if address == "" || isTrustedProxy(address) {
+			continue
+		}
+		if net.ParseIP(hostOf(address)) == nil {
+			break
+		}
+		return address
+	}
+	return req.RemoteAddr
+}
+
+// writeJSON writes the supplied value as JSON response body
+func writeJSON(writer http.ResponseWriter, status int, value interface{}) {
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+
+	err := json.NewEncoder(writer).Encode(value)
+	if err != nil {
+		log.Println("Cannot write JSON response:", err)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"scale-chat/chat"
+	"strconv"
+	"time"
+)
+
+// batchWriter is implemented by connections that can send several messages with a single write
+type batchWriter interface {
+	// WriteMessages sends the messages in their order, either as consecutive frames or as a single frame
+	WriteMessages(messages []*chat.Message) error
+}
+
+// writeBatchSize is the maximum number of queued messages that are written at once, 1 disables write coalescing
+var writeBatchSize = 32
+
+// writeBatchLatency is how long the outgoing handler waits for further messages before it writes a batch.
+// With 0 only messages that are already queued are coalesced.
+var writeBatchLatency time.Duration
+
+// initBatching reads the limits of the write batches from WRITE_BATCH_SIZE and WRITE_BATCH_LATENCY
+func initBatching() {
+	writeBatchSize = getEnvInt("WRITE_BATCH_SIZE", writeBatchSize)
+	if writeBatchSize < 1 {
+		writeBatchSize = 1
+	}
+	writeBatchLatency = getEnvDuration("WRITE_BATCH_LATENCY", writeBatchLatency)
+}
+
+// isJSON checks whether the codec is the JSON codec, which is the only codec that supports array frames
+func isJSON(codec chat.Codec) bool {
+	_, ok := codec.(chat.JSONCodec)
+	return ok
+}
+
+// acceptsBatches checks whether the client opted in to receive batches of JSON messages as a single array frame
+func acceptsBatches(req *http.Request) bool {
+	accepts, _ := strconv.ParseBool(req.URL.Query().Get(chat.BatchQuery))
+	return accepts
+}
+
+// nextBatch blocks until a message is queued and adds further queued messages up to the batch size.
+// Control messages keep their priority as every batch starts with the queued control messages.
+// It returns nil if the client is kicked or its incoming handler finished.
+func (client *Client) nextBatch() []*MessageWrapper {
+	wrapper := client.next()
+	if wrapper == nil {
+		return nil
+	}
+
+	batch := []*MessageWrapper{wrapper}
+	if writeBatchLatency <= 0 {
+		return client.fillBatch(batch)
+	}
+
+	timer := time.NewTimer(writeBatchLatency)
+	defer timer.Stop()
+
+	for len(batch) < writeBatchSize {
+		batch = client.fillBatch(batch)
+		if len(batch) == writeBatchSize {
+			break
+		}
+
+		select {
+		case <-client.ready:
+		case <-timer.C:
+			return batch
+		case <-client.done:
+			return batch
+		}
+	}
+	return batch
+}
+
+// fillBatch adds queued messages to the batch without blocking until it reaches the batch size
+func (client *Client) fillBatch(batch []*MessageWrapper) []*MessageWrapper {
+	for len(batch) < writeBatchSize {
+		wrapper := client.poll()
+		if wrapper == nil {
+			break
+		}
+		batch = append(batch, wrapper)
+	}
+	return batch
+}
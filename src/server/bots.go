@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"math/rand"
+	"os"
+	"regexp"
+	"scale-chat/chat"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Bot reads the chat messages of all rooms and can reply into the room of a message
+type Bot interface {
+	// Name identifies the bot in the configuration and the metrics, it is the sender of its replies
+	Name() string
+	// Handle returns the text of the reply to the message, or an empty string to stay silent
+	Handle(message chat.Message) string
+}
+
+// bots receives the chat messages that clients sent to this server, it is nil if no bots are configured
+var bots *BotDispatcher
+
+// botFactories creates the built-in bots by their name
+var botFactories = map[string]func() (Bot, error){
+	"dice": func() (Bot, error) { return DiceBot{}, nil },
+}
+
+// RegisterBot makes a bot available to the BOTS configuration
+func RegisterBot(name string, factory func() (Bot, error)) {
+	botFactories[name] = factory
+}
+
+// BotDispatcher passes messages to the bots in the background, so slow bots do not block the broadcasting loop
+type BotDispatcher struct {
+	bots  []Bot
+	queue chan chat.Message
+}
+
+// initBots starts the bots with the comma-separated names in BOTS, e.g. "dice"
+func initBots(incoming chan<- *MessageWrapper) {
+	names := os.Getenv("BOTS")
+	if strings.TrimSpace(names) == "" {
+		return
+	}
+
+	dispatcher := &BotDispatcher{queue: make(chan chat.Message, getEnvInt("BOT_QUEUE_SIZE", 1000))}
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		factory, ok := botFactories[name]
+		if !ok {
+			log.Fatal("Unknown bot: ", name)
+		}
+
+		bot, err := factory()
+		if err != nil {
+			log.Fatalf("Cannot create bot %v: %v", name, err)
+		}
+		dispatcher.bots = append(dispatcher.bots, bot)
+	}
+
+	bots = dispatcher
+	go dispatcher.run(incoming)
+
+	log.Println("Bots:", names)
+}
+
+// Notify queues a chat message for the bots. It never blocks, messages are dropped if the queue is full.
+func (dispatcher *BotDispatcher) Notify(message *chat.Message) {
+	if dispatcher == nil || message.Type != "" {
+		return
+	}
+
+	select {
+	case dispatcher.queue <- *message:
+	default:
+		log.Println("Bot queue is full, skipping the message")
+	}
+}
+
+// run passes the queued messages to all bots and submits their replies
+func (dispatcher *BotDispatcher) run(incoming chan<- *MessageWrapper) {
+	for message := range dispatcher.queue {
+		for _, bot := range dispatcher.bots {
+			text := bot.Handle(message)
+			if text == "" {
+				continue
+			}
+
+			BotRepliesCounterVec.WithLabelValues(bot.Name()).Inc()
+
+			SubmitSystemMessage(&chat.Message{
+				Id:     uuid.New().String(),
+				Text:   text,
+				Sender: bot.Name(),
+				SentAt: time.Now(),
+				Room:   message.Room,
+			}, incoming)
+		}
+	}
+}
+
+// dicePattern matches rolls like "!roll 2d6"
+var dicePattern = regexp.MustCompile(`^!roll\s+(\d{1,2})d(\d{1,4})\s*$`)
+
+// DiceBot answers "!roll <count>d<sides>" with the rolled numbers
+type DiceBot struct{}
+
+func (DiceBot) Name() string {
+	return "dice"
+}
+
+func (DiceBot) Handle(message chat.Message) string {
+	match := dicePattern.FindStringSubmatch(strings.TrimSpace(message.Text))
+	if match == nil {
+		return ""
+	}
+
+	count, _ := strconv.Atoi(match[1])
+	sides, _ := strconv.Atoi(match[2])
+	if count == 0 || sides == 0 {
+		return ""
+	}
+
+	rolls := make([]string, count)
+	total := 0
+	for i := range rolls {
+		roll := rand.Intn(sides) + 1
+		total += roll
+		rolls[i] = strconv.Itoa(roll)
+	}
+
+	return fmt.Sprintf("%v rolled %v: %v (total %v)", message.Sender, match[1]+"d"+match[2], strings.Join(rolls, " "), total)
+}
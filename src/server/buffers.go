@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/gorilla/websocket"
+	"log"
+	"sync"
+	"unsafe"
+)
+
+// writeBufferPool holds the write buffers of the websocket connections, so only connections that currently write hold one
+var writeBufferPool = &sync.Pool{}
+
+// frameBufferPool holds the buffers that collect the frames of a batch before they are written at once
+var frameBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// Estimates of memory that cannot be measured per connection
+const (
+	// goroutineStackEstimate is the stack of a handler goroutine, stacks start at 2 KB and grow while messages are written
+	goroutineStackEstimate = 4 << 10
+	// handlerGoroutines are the incoming and the outgoing handler of a client
+	handlerGoroutines = 2
+	// subscriptionEntryEstimate is the overhead of a subscription in the map of a client without the room's name
+	subscriptionEntryEstimate = 48
+	// channelEstimate is the overhead of a channel without its buffer, clients own the ready, kicked and done channels
+	channelEstimate = 96
+	clientChannels  = 3
+)
+
+// memoryEstimator is implemented by connections that can estimate the memory they hold
+type memoryEstimator interface {
+	// MemoryEstimate returns the estimated number of bytes of the connection's buffers and state
+	MemoryEstimate() int
+}
+
+// initBuffers reads the buffer sizes of the websocket connections and the size of the lanes
+func initBuffers() {
+	upgrader.ReadBufferSize = getEnvInt("WS_READ_BUFFER_SIZE", upgrader.ReadBufferSize)
+	upgrader.WriteBufferSize = getEnvInt("WS_WRITE_BUFFER_SIZE", upgrader.WriteBufferSize)
+	if getEnvBool("WS_WRITE_BUFFER_POOL", true) {
+		upgrader.WriteBufferPool = writeBufferPool
+	}
+
+	laneSize = getEnvInt("LANE_SIZE", laneSize)
+	if laneSize < 1 {
+		laneSize = 1
+	}
+
+	log.Printf("Websocket buffers: %v bytes read, %v bytes write (pooled: %v), lanes of %v messages",
+		upgrader.ReadBufferSize, upgrader.WriteBufferSize, upgrader.WriteBufferPool != nil, laneSize)
+}
+
+// MemoryEstimate returns the estimated number of bytes a client holds. Messages are not included,
+// because they are shared with the other clients of a room.
+func (client *Client) MemoryEstimate() int {
+	size := int(unsafe.Sizeof(*client)) + len(client.id) + len(client.Identity()) + clientChannels*channelEstimate
+	size += (client.control.Cap() + client.chat.Cap()) * int(unsafe.Sizeof(&MessageWrapper{}))
+
+	for _, room := range client.Rooms() {
+		size += len(room) + subscriptionEntryEstimate
+	}
+
+	// Clients of the netpoll engine are woken up instead of running their own handlers
+	if client.wake == nil {
+		size += handlerGoroutines * goroutineStackEstimate
+	}
+
+	if estimator, ok := client.conn.(memoryEstimator); ok {
+		size += estimator.MemoryEstimate()
+	}
+	return size
+}
+
+// MemoryEstimate includes the read buffer and, unless it is pooled, the write buffer of the connection
+func (conn *websocketConn) MemoryEstimate() int {
+	size := int(unsafe.Sizeof(*conn)) + int(unsafe.Sizeof(websocket.Conn{})) + upgrader.ReadBufferSize
+	if upgrader.WriteBufferPool == nil {
+		size += upgrader.WriteBufferSize
+	}
+	return size
+}
+
+// MemoryEstimate includes the frame reader of the connection
+func (conn *netpollConn) MemoryEstimate() int {
+	return int(unsafe.Sizeof(*conn)) + int(unsafe.Sizeof(wsutil.Reader{}))
+}
+
+// meanConnectionMemory returns the estimated mean memory of the active connections
+func meanConnectionMemory() float64 {
+	active := ActiveClients()
+	if len(active) == 0 {
+		return 0
+	}
+
+	total := 0
+	for _, client := range active {
+		total += client.MemoryEstimate()
+	}
+	return float64(total) / float64(len(active))
+}
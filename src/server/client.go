@@ -1,18 +1,59 @@
 package main
 
 import (
-	"github.com/gorilla/websocket"
+	"github.com/google/uuid"
 	"github.com/prometheus/client_golang/prometheus"
 	"log"
 	"scale-chat/chat"
 	"sync"
+	"time"
 )
 
+// Conn is the transport a client uses to exchange messages with the server
+type Conn interface {
+	// ReadMessage blocks until the client sent a new message or the connection broke
+	ReadMessage() (*chat.Message, error)
+	// WriteMessage sends a message to the client
+	WriteMessage(message *chat.Message) error
+	// Close closes the connection, a blocked ReadMessage call returns afterwards
+	Close() error
+	// Transport returns the name of the transport, e.g. websocket
+	Transport() string
+	// RemoteAddr returns the address of the client
+	RemoteAddr() string
+}
+
 type Client struct {
-	wsConn    *websocket.Conn
-	outgoing  chan *MessageWrapper
+	id   string
+	conn Conn
+	// control and chat are the lanes of the outgoing messages, see Lane
+	control laneQueue
+	chat    laneQueue
+	// ready notifies the outgoing handler about queued messages
+	ready     chan struct{}
 	waitGroup *sync.WaitGroup
-	room      string
+	// done is closed as soon as the incoming handler finished
+	done chan struct{}
+	// room is the default room of the messages the client sends, it can be changed with the join command
+	room string
+	// subscriptions contains all rooms the client receives messages of, including the default room
+	subscriptions map[string]bool
+	roomMutex     sync.RWMutex
+	// thread restricts the client to the messages of a single thread if it is set
+	thread string
+	// identity is the name of the client's user, it is taken from the first message if it was not declared
+	identity      string
+	identityMutex sync.Mutex
+	// verified is the identity the client proved with a token, it is empty for anonymous clients
+	verified    string
+	connectedAt time.Time
+	// kicked receives the reason if the client gets disconnected by the server
+	kicked chan string
+	// rate limits the messages the client sends
+	rate rateLimiter
+	// wake is called when a message is queued or the client is kicked. It is only set for connections
+	// without outgoing handler, which are flushed by the event loop instead.
+	wake func()
 }
 
 type Source int64
@@ -20,6 +61,7 @@ type Source int64
 const (
 	CLIENT Source = iota
 	DISTRIBUTOR
+	SERVER
 )
 
 type MessageWrapper struct {
@@ -28,25 +70,53 @@ type MessageWrapper struct {
 	source          Source
 }
 
-//HandleOutgoing sends outgoing messages to the client's websocket connection
+// HandleOutgoing sends outgoing messages to the client's connection
 func (client *Client) HandleOutgoing() {
 	defer func() {
 		log.Println("Client's outgoing handler finished")
 		client.waitGroup.Done()
 	}()
 
-	for wrapper := range client.outgoing {
-		data, err := wrapper.message.MarshalBinary()
-		if err != nil {
-			continue
+	for {
+		batch := client.nextBatch()
+		if batch == nil {
+			return
 		}
 
-		err = client.wsConn.WriteMessage(websocket.TextMessage, data)
+		err := client.deliver(batch)
 		if err != nil {
-			log.Println("Cannot send message via WebSocket", err)
+			log.Printf("Cannot send message via %v: %v", client.conn.Transport(), err)
 			return
 		}
+	}
+}
+
+// deliver writes a batch of queued messages to the client's connection.
+// Connections that implement batchWriter send the whole batch at once.
+func (client *Client) deliver(batch []*MessageWrapper) error {
+	writer, ok := client.conn.(batchWriter)
+	if ok && len(batch) > 1 {
+		messages := make([]*chat.Message, len(batch))
+		for i, wrapper := range batch {
+			messages[i] = wrapper.message
+		}
+
+		err := writer.WriteMessages(messages)
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, wrapper := range batch {
+			err := client.conn.WriteMessage(wrapper.message)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	WriteBatchSizeVec.WithLabelValues(client.conn.Transport()).Observe(float64(len(batch)))
 
+	for _, wrapper := range batch {
 		wrapper.processingTimer.ObserveDuration()
 
 		if wrapper.source == CLIENT {
@@ -56,38 +126,271 @@ func (client *Client) HandleOutgoing() {
 		if wrapper.source == DISTRIBUTOR {
 			MessageCounterVec.WithLabelValues("outgoing_from_distributor").Inc()
 		}
+
+		if wrapper.source == SERVER {
+			MessageCounterVec.WithLabelValues("outgoing_from_server").Inc()
+		}
+	}
+
+	return nil
+}
+
+// Kick disconnects the client. The reason is sent to the client before the connection is closed.
+func (client *Client) Kick(reason string) {
+	select {
+	case client.kicked <- reason:
+		client.wakeup()
+	default:
+		// The client is already being kicked
 	}
 }
 
-// HandleIncoming reads new messages from the websocket connection
+// disconnect notifies the client about the reason and closes the connection,
+// which lets the incoming handler finish as well
+func (client *Client) disconnect(reason string) {
+	log.Println("Disconnecting client:", reason)
+
+	err := client.conn.WriteMessage(NewSystemMessage(client.Room(), reason))
+	if err != nil {
+		log.Printf("Cannot send disconnect reason via %v: %v", client.conn.Transport(), err)
+	}
+
+	_ = client.conn.Close()
+}
+
+// HandleIncoming reads new messages from the client's connection
 // and broadcasts them to the other clients
 func (client *Client) HandleIncoming(incoming chan<- *MessageWrapper) {
 	defer func() {
 		log.Println("Client's incoming handler finished")
+		close(client.done)
 		client.waitGroup.Done()
 	}()
 
+	client.enforceBans()
+
 	for {
-		_, data, err := client.wsConn.ReadMessage()
+		message, err := client.conn.ReadMessage()
 		if err != nil {
-			log.Println("Cannot read message on websocket connection:", err)
+			log.Printf("Cannot read message on %v connection: %v", client.conn.Transport(), err)
 			return
 		}
 
-		timer := prometheus.NewTimer(MessageProcessingTime)
+		client.handleMessage(message, incoming)
+	}
+}
 
-		MessageCounterVec.WithLabelValues("incoming_from_client").Inc()
+// handleMessage processes a message the client sent, it is either a subscription change, a command or
+// a message that is broadcast. It returns the id of the broadcast message, which is empty otherwise.
+func (client *Client) handleMessage(message *chat.Message, incoming chan<- *MessageWrapper) string {
+	if client.Identity() == "" {
+		if err := claimIdentity(message.Sender, client.verified); err != nil {
+			client.Notify(err.Error())
+			return ""
+		}
+		client.SetIdentity(message.Sender)
+	}
 
-		log.Printf("Received raw message: %s", data)
+	// The identity might only be known after the first message, so bans are checked again
+	if client.enforceBans() {
+		return ""
+	}
 
-		var message chat.Message
-		err = message.UnmarshalBinary(data)
-		if err != nil {
-			continue
-		}
+	rate, burst := shedder.RateLimit(clientRateLimit, clientRateBurst)
+	if !client.rate.Allow(time.Now(), rate, burst) {
+		RateLimitedCounter.Inc()
+		client.Notify("You are sending messages too fast, your message was dropped")
+		return ""
+	}
 
-		wrapper := MessageWrapper{message: &message, processingTimer: timer, source: CLIENT}
+	if message.Type == chat.SubscribeMessage || message.Type == chat.UnsubscribeMessage {
+		client.handleSubscription(message)
+		return ""
+	}
 
-		incoming <- &wrapper
+	if IsCommand(message) {
+		client.runCommand(message, incoming)
+		return ""
 	}
+
+	return client.Submit(message, incoming)
+}
+
+// Submit sends a message of the client into the message's room or the client's default room if it is empty,
+// unless the client is muted or its role does not allow it. It returns the id of the message, which is empty
+// if the message was rejected.
+func (client *Client) Submit(message *chat.Message, incoming chan<- *MessageWrapper) string {
+	if message.Room == "" {
+		message.Room = client.Room()
+	}
+
+	// Clients can only send messages into the rooms they subscribed to
+	if !client.Subscribed(message.Room) {
+		client.Notify("You are not subscribed to room " + displayRoom(message.Room))
+		return ""
+	}
+
+	if mute := moderation.Find(MuteSanction, client.Identity(), client.IP(), message.Room); mute != nil {
+		client.Notify(sanctionNotice(mute))
+		return ""
+	}
+
+	if err := authorize(client.Identity(), client.Authenticated(), message); err != nil {
+		client.Notify(err.Error())
+		return ""
+	}
+
+	// Clients can only send messages in their own name
+	message.Sender = client.Identity()
+
+	id, err := SubmitMessage(client.messageContext(), message, incoming)
+	if err != nil {
+		client.Notify(err.Error())
+	}
+	return id
+}
+
+// messageContext describes the client for the middlewares
+func (client *Client) messageContext() *MessageContext {
+	return &MessageContext{Identity: client.Identity(), Authenticated: client.Authenticated(), IP: client.IP(), Session: client.id}
+}
+
+// Notify sends a system message to this client only. It is dropped if the client's queue is full.
+func (client *Client) Notify(text string) {
+	client.send(NewSystemMessage(client.Room(), text))
+}
+
+// send passes a message that was created by the server to this client only
+func (client *Client) send(message *chat.Message) {
+	timer := prometheus.NewTimer(MessageProcessingTime)
+
+	MessageCounterVec.WithLabelValues("incoming_from_server").Inc()
+
+	client.enqueue(&MessageWrapper{message: message, processingTimer: timer, source: SERVER})
+}
+
+// IP returns the client's IP address without port
+func (client *Client) IP() string {
+	return hostOf(client.conn.RemoteAddr())
+}
+
+// Info returns a snapshot of the client's connection details
+func (client *Client) Info() ConnectionInfo {
+	return ConnectionInfo{
+		Id:            client.id,
+		Transport:     client.conn.Transport(),
+		RemoteAddress: client.conn.RemoteAddr(),
+		Identity:      client.Identity(),
+		Room:          client.Room(),
+		Rooms:         client.Rooms(),
+		Thread:        client.thread,
+		ConnectedAt:   client.connectedAt,
+		QueueDepth:    client.chat.Len(),
+		ControlDepth:  client.control.Len(),
+		MemoryBytes:   client.MemoryEstimate(),
+	}
+}
+
+// Identity returns the name of the client's user
+func (client *Client) Identity() string {
+	client.identityMutex.Lock()
+	defer client.identityMutex.Unlock()
+	return client.identity
+}
+
+// Authenticated indicates whether the client's current identity was verified with a token
+func (client *Client) Authenticated() bool {
+	return client.verified != "" && client.Identity() == client.verified
+}
+
+// SetIdentity changes the name of the client's user
+func (client *Client) SetIdentity(identity string) {
+	client.identityMutex.Lock()
+	defer client.identityMutex.Unlock()
+	client.identity = identity
+}
+
+// Room returns the default room of the client
+func (client *Client) Room() string {
+	client.roomMutex.RLock()
+	defer client.roomMutex.RUnlock()
+	return client.room
+}
+
+// SetRoom moves the client into another default room and drops the subscription of the previous one
+func (client *Client) SetRoom(room string) {
+	client.roomMutex.Lock()
+	defer client.roomMutex.Unlock()
+	delete(client.subscriptions, client.room)
+	client.subscriptions[room] = true
+	client.room = room
+}
+
+// SubmitMessage assigns a server id to a message that was sent by a client, runs it through the middleware pipeline
+// and passes it to the broadcasting loop. It returns the assigned id or the reason why a middleware rejected the message.
+func SubmitMessage(ctx *MessageContext, message *chat.Message, incoming chan<- *MessageWrapper) (string, error) {
+	timer := prometheus.NewTimer(MessageProcessingTime)
+
+	MessageCounterVec.WithLabelValues("incoming_from_client").Inc()
+
+	id := uuid.New().String()
+	message.Id = id
+	message.Thread = nil
+	// Only the server is allowed to send system messages
+	if !chat.IsClientType(message.Type) {
+		message.Type = ""
+	}
+	if message.Room == chat.AllRooms {
+		message.Room = ""
+	}
+
+	err := pipeline.Process(ctx, message)
+	if err != nil {
+		return "", err
+	}
+
+	wrapper := MessageWrapper{message: message, processingTimer: timer, source: CLIENT}
+
+	incoming <- &wrapper
+
+	return id, nil
+}
+
+// SubmitSystemMessage passes a message that was created by the server to the broadcasting loop.
+// System messages with the room AllRooms are sent to the clients of all rooms.
+func SubmitSystemMessage(message *chat.Message, incoming chan<- *MessageWrapper) {
+	timer := prometheus.NewTimer(MessageProcessingTime)
+
+	MessageCounterVec.WithLabelValues("incoming_from_server").Inc()
+
+	wrapper := MessageWrapper{message: message, processingTimer: timer, source: SERVER}
+
+	incoming <- &wrapper
+}
+
+// NewSystemMessage creates a system message for the supplied room
+func NewSystemMessage(room string, text string) *chat.Message {
+	return &chat.Message{
+		Id:     uuid.New().String(),
+		Type:   chat.SystemMessage,
+		Text:   text,
+		Sender: chat.SystemMessage,
+		SentAt: time.Now(),
+		Room:   room,
+	}
+}
+
+// ConnectionInfo describes a connected client
+type ConnectionInfo struct {
+	Id            string    `json:"id"`
+	Transport     string    `json:"transport"`
+	RemoteAddress string    `json:"remote_address"`
+	Identity      string    `json:"identity"`
+	Room          string    `json:"room"`
+	Rooms         []string  `json:"rooms"`
+	Thread        string    `json:"thread,omitempty"`
+	ConnectedAt   time.Time `json:"connected_at"`
+	QueueDepth    int       `json:"queue_depth"`
+	ControlDepth  int       `json:"control_queue_depth"`
+	MemoryBytes   int       `json:"memory_bytes"`
 }
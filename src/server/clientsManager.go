@@ -1,79 +1,213 @@
 package main
 
 import (
-	"github.com/gorilla/websocket"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
 	"log"
 	"scale-chat/chat"
 	"sync"
+	"time"
 )
 
-// messageBufferSize is the buffer size of the incoming and outgoing message channels
+// messageBufferSize is the buffer size of the incoming channel and the default size of each lane of the outgoing messages
 const messageBufferSize = 100
 
 // clients that are connected to the server
 var clients = make([]*Client, 0)
 
+// clientsMutex guards the clients slice, which is modified by the connection handlers
+// while the broadcasting loop iterates over it
+var clientsMutex sync.RWMutex
+
 // incoming messages are sent through this channel
 var incoming = make(chan *MessageWrapper, messageBufferSize)
 
 // StartClient starts a client's incoming and outgoing message handlers
-// and waits until the connection breaks to remove the client
-func StartClient(wsConn *websocket.Conn, room string) {
-	outgoing := make(chan *MessageWrapper, messageBufferSize)
-
-	waitGroup := sync.WaitGroup{}
-	waitGroup.Add(2)
-
-	client := Client{
-		wsConn:    wsConn,
-		outgoing:  outgoing,
-		waitGroup: &waitGroup,
-		room:      room,
+// and waits until the connection breaks to remove the client.
+// If a thread is supplied, the client only receives the messages of that thread.
+// The identity is the name the client declared when connecting, it might be empty.
+func StartClient(conn Conn, room string, thread string, identity string, verified string) {
+	NewClient(conn, room, thread, identity, verified).Run()
+}
+
+// NewClient creates a client for the supplied connection without starting it.
+// The verified identity is the identity the client proved with a token, it is empty otherwise.
+func NewClient(conn Conn, room string, thread string, identity string, verified string) *Client {
+	return &Client{
+		id:            uuid.New().String(),
+		conn:          conn,
+		ready:         make(chan struct{}, 1),
+		waitGroup:     &sync.WaitGroup{},
+		done:          make(chan struct{}),
+		room:          room,
+		subscriptions: map[string]bool{room: true},
+		thread:        thread,
+		identity:      identity,
+		verified:      verified,
+		connectedAt:   time.Now(),
+		kicked:        make(chan string, 1),
 	}
-	clients = append(clients, &client)
+}
 
-	go client.HandleOutgoing()
-	go client.HandleIncoming(incoming)
+// Run runs the client's incoming and outgoing message handlers
+// until the connection breaks and removes the client afterwards
+func (client *Client) Run() {
+	client.waitGroup.Add(2)
+
+	client.register()
 
-	// Wait for both handlers
 	log.Println("Started a client")
-	waitGroup.Wait()
 
-	// Remove client from the list of active clients
-	removeClient(&client)
+	// The incoming handler runs in this goroutine, so a client only costs one further goroutine
+	go client.HandleOutgoing()
+	client.HandleIncoming(incoming)
 
-	// Try to close websocket connection
-	_ = closeWsConn(wsConn)
+	// Wait for the outgoing handler
+	client.waitGroup.Wait()
+
+	client.unregister()
+
+	// Try to close the connection
+	_ = client.conn.Close()
 
 	log.Println("Client is gone")
 }
 
+// register adds the client to the list of active clients
+func (client *Client) register() {
+	addClient(client)
+	addSession(client)
+	webhooks.Notify(WebhookJoin, client.Room(), client.Identity(), nil)
+}
+
+// unregister removes the client from the list of active clients and releases its rooms
+func (client *Client) unregister() {
+	removeClient(client)
+	removeSession(client)
+	rooms := client.dropSubscriptions()
+	limiter.Release(client.IP(), rooms)
+	for _, room := range rooms {
+		webhooks.Notify(WebhookLeave, room, client.Identity(), nil)
+	}
+}
+
 // BroadcastMessages listens for messages on the incoming channel and sends them to all connected clients
 func BroadcastMessages(enableDistribution bool, outgoing chan<- *chat.Message) {
 	for wrapper := range incoming {
+		update := applyAction(wrapper)
+
+		// Webhooks and bots are only notified by the server that received the message, the other servers skip it
+		if wrapper.source == CLIENT {
+			webhooks.Notify(WebhookMessage, wrapper.message.Room, wrapper.message.Sender, wrapper.message)
+
+			if !shedder.DropsLowPriority() {
+				bots.Notify(wrapper.message)
+			} else if bots != nil {
+				SheddingDropsCounterVec.WithLabelValues("bot").Inc()
+			}
+		}
+
 		if enableDistribution && wrapper.source != DISTRIBUTOR {
 			outgoing <- wrapper.message
 		}
 
-		for _, client := range clients {
-			if wrapper.message.Room != client.room {
-				continue
-			}
+		broadcast(wrapper)
 
-			// By providing a default case, we avoid blocking the main broadcasting loop
-			// in case the buffer of the outgoing channel is full.
-			select {
-			case client.outgoing <- wrapper:
-			default:
-				log.Println("Client's outgoing channel is full, skipping the message")
-			}
+		// Every server keeps its own history, so thread updates are not distributed
+		if update != nil {
+			timer := prometheus.NewTimer(MessageProcessingTime)
+			MessageCounterVec.WithLabelValues("incoming_from_server").Inc()
+			broadcast(&MessageWrapper{message: update, processingTimer: timer, source: SERVER})
 		}
 	}
 }
 
+// broadcast enqueues the message for all connected clients that subscribed to its room
+func broadcast(wrapper *MessageWrapper) {
+	clientsMutex.RLock()
+	defer clientsMutex.RUnlock()
+
+	for _, client := range clients {
+		if wrapper.message.Room != chat.AllRooms && !client.Subscribed(wrapper.message.Room) {
+			continue
+		}
+
+		// Thread clients receive all system messages and actions, but only the chat messages of their thread
+		if client.thread != "" && wrapper.message.Type == "" &&
+			wrapper.message.Id != client.thread && wrapper.message.ParentId != client.thread {
+			continue
+		}
+
+		// Chat messages for clients that lag behind are dropped early while the server sheds load
+		if wrapper.message.Type == "" && shedder.DropsLowPriority() && client.chat.Len() > laneSize/2 {
+			SheddingDropsCounterVec.WithLabelValues("lagging_client").Inc()
+			continue
+		}
+
+		// Enqueueing never blocks the main broadcasting loop, even if the client's lanes are full
+		client.enqueue(wrapper)
+	}
+}
+
+// RoomMembers returns the distinct identities of the clients that subscribed to a room. Clients without identity are omitted.
+func RoomMembers(room string) []string {
+	clientsMutex.RLock()
+	defer clientsMutex.RUnlock()
+
+	members := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, client := range clients {
+		identity := client.Identity()
+		if !client.Subscribed(room) || identity == "" || seen[identity] {
+			continue
+		}
+		seen[identity] = true
+		members = append(members, identity)
+	}
+	return members
+}
+
+// RenameClient changes the identity of the client unless another client is connected with it. The check and the change
+// happen under the lock of the clients, so two clients cannot take the same name at once.
+func RenameClient(client *Client, identity string) bool {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	for _, other := range clients {
+		if other != client && other.Identity() == identity {
+			return false
+		}
+	}
+	client.SetIdentity(identity)
+	return true
+}
+
+// ActiveClients returns a snapshot of the list of active clients
+func ActiveClients() []*Client {
+	clientsMutex.RLock()
+	defer clientsMutex.RUnlock()
+
+	snapshot := make([]*Client, len(clients))
+	copy(snapshot, clients)
+	return snapshot
+}
+
+// addClient adds a client to the list of active clients
+func addClient(client *Client) {
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
+	clients = append(clients, client)
+	ConnectionsGaugeVec.WithLabelValues(client.conn.Transport()).Inc()
+}
+
 // removeClient filters through the slice of active clients and removes the supplied reference.
 func removeClient(client *Client) {
 	log.Println("Removing client from list of active clients")
+
+	clientsMutex.Lock()
+	defer clientsMutex.Unlock()
+
 	filteredClients := make([]*Client, 0)
 	for _, c := range clients {
 		if c != client {
@@ -81,15 +215,5 @@ func removeClient(client *Client) {
 		}
 	}
 	clients = filteredClients
-}
-
-// closeWsConn tries to close the websocket connection
-func closeWsConn(wsConn *websocket.Conn) error {
-	log.Println("Trying to close websocket connection")
-	err := wsConn.Close()
-	if err != nil {
-		log.Println("Failed to close websocket connection gracefully")
-		return err
-	}
-	return nil
+	ConnectionsGaugeVec.WithLabelValues(client.conn.Transport()).Dec()
 }
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"scale-chat/chat"
+	"sort"
+	"strings"
+	"time"
+)
+
+// CommandPrefix starts the text of messages that are handled as commands instead of being broadcast.
+// Texts starting with two prefixes are sent as normal messages with a single prefix.
+const CommandPrefix = "/"
+
+// Command is a slash command that clients can run, e.g. /who
+type Command struct {
+	Name string
+	// Usage describes the arguments of the command, e.g. "<room> [password]"
+	Usage       string
+	Description string
+	Handler     CommandHandler
+}
+
+// CommandHandler runs a command. The returned error is reported to the client that ran the command.
+type CommandHandler func(ctx *CommandContext) error
+
+// CommandContext describes the command a client ran
+type CommandContext struct {
+	Client  *Client
+	Message *chat.Message
+	// Room is the room the command was sent to, it is the client's default room if the message has no room
+	Room string
+	// Args is the text after the command name with surrounding whitespace removed
+	Args     string
+	incoming chan<- *MessageWrapper
+}
+
+// Reply sends a system message to the client that ran the command
+func (ctx *CommandContext) Reply(text string) {
+	ctx.Client.Notify(text)
+}
+
+// Post sends a message of the client into the command's room, like a message that was not a command
+func (ctx *CommandContext) Post(message *chat.Message) {
+	message.Room = ctx.Room
+	ctx.Client.Submit(message, ctx.incoming)
+}
+
+// Announce sends a system message to all clients in the command's room. The announcement is triggered by the client,
+// so it is rejected if the client is muted or a middleware rejects it.
+func (ctx *CommandContext) Announce(text string) error {
+	message, err := ctx.announcement(text)
+	if err != nil {
+		return err
+	}
+
+	SubmitSystemMessage(message, ctx.incoming)
+	return nil
+}
+
+// announcement creates the system message of an announcement and checks it like Announce, but does not send it
+func (ctx *CommandContext) announcement(text string) (*chat.Message, error) {
+	if mute := moderation.Find(MuteSanction, ctx.Client.Identity(), ctx.Client.IP(), ctx.Room); mute != nil {
+		return nil, errors.New(sanctionNotice(mute))
+	}
+
+	message := NewSystemMessage(ctx.Room, text)
+	if err := pipeline.Process(ctx.Client.messageContext(), message); err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// commands contains the commands by their name, the built-in commands are registered by initCommands
+var commands = map[string]Command{}
+
+// RegisterCommand makes a command available to all clients, it replaces a command with the same name
+func RegisterCommand(command Command) {
+	commands[strings.ToLower(command.Name)] = command
+}
+
+// initCommands registers the built-in commands
+func initCommands() {
+	RegisterCommand(Command{Name: "nick", Usage: "<name>", Description: "changes your name", Handler: nickCommand})
+	RegisterCommand(Command{Name: "me", Usage: "<action>", Description: "describes what you are doing", Handler: meCommand})
+	RegisterCommand(Command{Name: "join", Usage: "<room> [password]", Description: "moves you into another room", Handler: joinCommand})
+	RegisterCommand(Command{Name: "subscribe", Usage: "<room> [password]", Description: "receives the messages of another room as well", Handler: subscribeCommand})
+	RegisterCommand(Command{Name: "unsubscribe", Usage: "<room>", Description: "stops receiving the messages of a room", Handler: unsubscribeCommand})
+	RegisterCommand(Command{Name: "leave", Description: "leaves the room, leaving the default room disconnects", Handler: leaveCommand})
+	RegisterCommand(Command{Name: "who", Description: "lists the members of the room", Handler: whoCommand})
+	RegisterCommand(Command{Name: "topic", Usage: "[topic]", Description: "shows or changes the topic of the room", Handler: topicCommand})
+	RegisterCommand(Command{Name: "help", Description: "lists the commands", Handler: helpCommand})
+}
+
+// IsCommand indicates whether the text of a chat message starts with the command prefix
+func IsCommand(message *chat.Message) bool {
+	return message.Type == "" && strings.HasPrefix(message.Text, CommandPrefix)
+}
+
+// runCommand parses the message and runs the command it names
+func (client *Client) runCommand(message *chat.Message, incoming chan<- *MessageWrapper) {
+	text := strings.TrimPrefix(message.Text, CommandPrefix)
+
+	// A doubled prefix escapes the command, e.g. "//shrug" is sent as "/shrug"
+	if strings.HasPrefix(text, CommandPrefix) {
+		message.Text = text
+		client.Submit(message, incoming)
+		return
+	}
+
+	name, args := text, ""
+	if i := strings.IndexAny(text, " \t"); i >= 0 {
+		name, args = text[:i], strings.TrimSpace(text[i+1:])
+	}
+	name = strings.ToLower(name)
+
+	command, ok := commands[name]
+	if !ok {
+		CommandCounterVec.WithLabelValues("unknown").Inc()
+		client.Notify(fmt.Sprintf("Unknown command %v%v, try %vhelp", CommandPrefix, name, CommandPrefix))
+		return
+	}
+
+	CommandCounterVec.WithLabelValues(command.Name).Inc()
+
+	room := message.Room
+	if room == "" || !client.Subscribed(room) {
+		room = client.Room()
+	}
+
+	ctx := &CommandContext{Client: client, Message: message, Room: room, Args: args, incoming: incoming}
+	if err := command.Handler(ctx); err != nil {
+		client.Notify(err.Error())
+	}
+}
+
+// nickCommand changes the identity of the client and announces it to the room
+func nickCommand(ctx *CommandContext) error {
+	if ctx.Args == "" || strings.ContainsAny(ctx.Args, " \t") {
+		return errors.New("usage: /nick <name>")
+	}
+
+	if ban := moderation.Find(BanSanction, ctx.Args, ctx.Client.IP(), ctx.Room); ban != nil {
+		return errors.New("you cannot use this name: " + sanctionNotice(ban))
+	}
+
+	if err := claimIdentity(ctx.Args, ctx.Client.verified); err != nil {
+		return err
+	}
+
+	// Muted clients cannot change their name, as a new name would not be muted. The announcement is checked
+	// with the previous name and sent once the new name is taken.
+	previous := ctx.Client.Identity()
+	var announcement *chat.Message
+	if previous != "" {
+		var err error
+		announcement, err = ctx.announcement(fmt.Sprintf("%v is now known as %v", previous, ctx.Args))
+		if err != nil {
+			return fmt.Errorf("you cannot change your name: %w", err)
+		}
+	}
+
+	if !RenameClient(ctx.Client, ctx.Args) {
+		return errors.New("the name " + ctx.Args + " is already in use")
+	}
+
+	// The bans of the new name apply to all rooms of the client
+	if ctx.Client.enforceBans() {
+		return nil
+	}
+
+	if announcement == nil {
+		ctx.Reply("You are now known as " + ctx.Args)
+	} else {
+		SubmitSystemMessage(announcement, ctx.incoming)
+	}
+	return nil
+}
+
+// meCommand posts an action of the client, e.g. "/me waves" is sent as "* alice waves"
+func meCommand(ctx *CommandContext) error {
+	if ctx.Args == "" {
+		return errors.New("usage: /me <action>")
+	}
+
+	ctx.Post(&chat.Message{
+		Text:   fmt.Sprintf("* %v %v", ctx.Client.Identity(), ctx.Args),
+		Sender: ctx.Client.Identity(),
+		SentAt: time.Now(),
+	})
+	return nil
+}
+
+// joinCommand moves the client into another room if it is allowed to join it
+func joinCommand(ctx *CommandContext) error {
+	fields := strings.Fields(ctx.Args)
+	if len(fields) == 0 || len(fields) > 2 {
+		return errors.New("usage: /join <room> [password]")
+	}
+
+	room, password := fields[0], ""
+	if len(fields) == 2 {
+		password = fields[1]
+	}
+
+	if room == chat.AllRooms {
+		return errors.New("you cannot join all rooms")
+	}
+
+	// Thread clients only receive the messages of a single thread, which belongs to their room
+	if ctx.Client.thread != "" {
+		return errors.New("clients that follow a thread cannot change the room")
+	}
+
+	previous := ctx.Client.Room()
+	if room == previous {
+		return errors.New("you are already in room " + displayRoom(room))
+	}
+
+	identity := ctx.Client.Identity()
+	if ban := moderation.Find(BanSanction, identity, ctx.Client.IP(), room); ban != nil {
+		return errors.New(sanctionNotice(ban))
+	}
+
+	if err := rooms.Admit(room, identity, ctx.Client.Authenticated(), password); err != nil {
+		return fmt.Errorf("you cannot join room %v: %w", displayRoom(room), err)
+	}
+
+	// Clients that already subscribed to the room are counted as its members
+	if !ctx.Client.Subscribed(room) {
+		if err := limiter.AcquireRoom(room); err != nil {
+			return fmt.Errorf("you cannot join room %v: %w", displayRoom(room), err)
+		}
+	}
+
+	ctx.Client.SetRoom(room)
+	limiter.ReleaseRoom(previous)
+
+	webhooks.Notify(WebhookLeave, previous, identity, nil)
+	webhooks.Notify(WebhookJoin, room, identity, nil)
+
+	ctx.Reply("You joined room " + displayRoom(room))
+	if topic := rooms.Get(room).Topic; topic != "" {
+		ctx.Reply("Topic: " + topic)
+	}
+	return nil
+}
+
+// subscribeCommand adds a room to the client, like a subscribe frame
+func subscribeCommand(ctx *CommandContext) error {
+	fields := strings.Fields(ctx.Args)
+	if len(fields) == 0 || len(fields) > 2 {
+		return errors.New("usage: /subscribe <room> [password]")
+	}
+
+	frame := &chat.Message{Type: chat.SubscribeMessage, Room: fields[0]}
+	if len(fields) == 2 {
+		frame.Text = fields[1]
+	}
+	ctx.Client.handleSubscription(frame)
+	return nil
+}
+
+// unsubscribeCommand removes a room from the client, like an unsubscribe frame
+func unsubscribeCommand(ctx *CommandContext) error {
+	if ctx.Args == "" || strings.ContainsAny(ctx.Args, " \t") {
+		return errors.New("usage: /unsubscribe <room>")
+	}
+
+	ctx.Client.handleSubscription(&chat.Message{Type: chat.UnsubscribeMessage, Room: ctx.Args})
+	return nil
+}
+
+// leaveCommand unsubscribes the client from the command's room, or disconnects it if it is the default room
+func leaveCommand(ctx *CommandContext) error {
+	ctx.Client.Remove(ctx.Room, "You left room "+displayRoom(ctx.Room))
+	return nil
+}
+
+// whoCommand lists the identities of the clients in the room
+func whoCommand(ctx *CommandContext) error {
+	room := ctx.Room
+	members := RoomMembers(room)
+	sort.Strings(members)
+
+	ctx.Reply(fmt.Sprintf("%v members in room %v: %v", len(members), displayRoom(room), strings.Join(members, ", ")))
+	return nil
+}
+
+// topicCommand shows the topic of the room or changes it, if the client's role allows it
+func topicCommand(ctx *CommandContext) error {
+	if ctx.Args == "" {
+		topic := rooms.Get(ctx.Room).Topic
+		if topic == "" {
+			ctx.Reply("No topic is set")
+		} else {
+			ctx.Reply("Topic: " + topic)
+		}
+		return nil
+	}
+
+	ctx.Post(&chat.Message{
+		Type:   chat.TopicMessage,
+		Text:   ctx.Args,
+		Sender: ctx.Client.Identity(),
+		SentAt: time.Now(),
+	})
+	return nil
+}
+
+// helpCommand lists the registered commands
+func helpCommand(ctx *CommandContext) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		command := commands[name]
+		usage := CommandPrefix + command.Name
+		if command.Usage != "" {
+			usage += " " + command.Usage
+		}
+		lines = append(lines, fmt.Sprintf("%v - %v", usage, command.Description))
+	}
+
+	ctx.Reply("Commands:\n" + strings.Join(lines, "\n"))
+	return nil
+}
+
+// displayRoom returns a readable name of a room, the default room has an empty name
+func displayRoom(room string) string {
+	if room == "" {
+		return "(default)"
+	}
+	return room
+}
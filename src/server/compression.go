@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// defaultCompressionThreshold is the minimum size in bytes of a message to be sent compressed
+const defaultCompressionThreshold = 256
+
+// compressionThreshold is the minimum size in bytes of an outgoing message to be sent compressed
+var compressionThreshold = defaultCompressionThreshold
+
+// compressionLevel of the permessage-deflate extension
+var compressionLevel = flate.BestSpeed
+
+// initCompression configures the permessage-deflate extension of the websocket upgrader
+func initCompression() {
+	upgrader.EnableCompression = getEnvBool("WS_COMPRESSION", false)
+	compressionLevel = getEnvInt("WS_COMPRESSION_LEVEL", flate.BestSpeed)
+	compressionThreshold = getEnvInt("WS_COMPRESSION_THRESHOLD", defaultCompressionThreshold)
+}
+
+// offersCompression checks whether the client offered the permessage-deflate extension during the handshake
+func offersCompression(req *http.Request) bool {
+	for _, extensions := range req.Header.Values("Sec-WebSocket-Extensions") {
+		if strings.Contains(extensions, "permessage-deflate") {
+			return true
+		}
+	}
+	return false
+}
+
+// countingListener wraps the accepted connections into countingConns
+type countingListener struct {
+	net.Listener
+}
+
+func (listener countingListener) Accept() (net.Conn, error) {
+	conn, err := listener.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &countingConn{Conn: conn}, nil
+}
+
+// countingConn counts the bytes that are written to the wire. As websocket connections hijack
+// the underlying connection, this is used to measure the size of compressed frames.
+// It also coalesces the frames of a batch into a single write, see Cork.
+type countingConn struct {
+	net.Conn
+	written uint64
+	// buffer collects the writes while the connection is corked, it is taken from the frameBufferPool
+	buffer *bytes.Buffer
+	mutex  sync.Mutex
+}
+
+func (conn *countingConn) Write(data []byte) (int, error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	if conn.buffer != nil {
+		atomic.AddUint64(&conn.written, uint64(len(data)))
+		return conn.buffer.Write(data)
+	}
+
+	n, err := conn.Conn.Write(data)
+	atomic.AddUint64(&conn.written, uint64(n))
+	return n, err
+}
+
+// Cork collects the following writes until Uncork is called
+func (conn *countingConn) Cork() {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+	if conn.buffer == nil {
+		conn.buffer = frameBufferPool.Get().(*bytes.Buffer)
+	}
+}
+
+// Uncork writes the collected data with a single write and passes further writes through again
+func (conn *countingConn) Uncork() error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	buffer := conn.buffer
+	if buffer == nil {
+		return nil
+	}
+	conn.buffer = nil
+
+	var err error
+	if buffer.Len() > 0 {
+		_, err = conn.Conn.Write(buffer.Bytes())
+	}
+	buffer.Reset()
+	frameBufferPool.Put(buffer)
+	return err
+}
+
+// Written returns the number of bytes that were written to the connection so far
+func (conn *countingConn) Written() uint64 {
+	return atomic.LoadUint64(&conn.written)
+}
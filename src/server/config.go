@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// getEnvInt reads an integer env variable and falls back to the default value
+// if the variable is not set or cannot be parsed
+func getEnvInt(name string, defaultValue int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Could not parse %v env variable, using default value %v", name, defaultValue)
+		return defaultValue
+	}
+
+	return parsed
+}
+
+// getEnvBool reads a boolean env variable and falls back to the default value
+// if the variable is not set or cannot be parsed
+func getEnvBool(name string, defaultValue bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Could not parse %v env variable, using default value %v", name, defaultValue)
+		return defaultValue
+	}
+
+	return parsed
+}
+
+// getEnvDuration reads a duration env variable like "30s" and falls back to the default value
+// if the variable is not set or cannot be parsed
+func getEnvDuration(name string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue
+	}
+
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Could not parse %v env variable, using default value %v", name, defaultValue)
+		return defaultValue
+	}
+
+	return parsed
+}
@@ -3,26 +3,30 @@ package main
 import (
 	"context"
 	"encoding/json"
-	"github.com/go-redis/redis/v8"
+	"fmt"
 	"github.com/prometheus/client_golang/prometheus"
 	"log"
 	"scale-chat/chat"
-	"time"
 )
 
-type Distributor struct {
-	Server         string
-	ServerPassword string
-	Incoming       chan<- *chat.Message
-	Outgoing       <-chan *chat.Message
-	Topic          string
-	client         redis.Client
-	ctx            context.Context
+// Distributor exchanges the messages of this server with the other servers of the cluster
+type Distributor interface {
+	// Connect establishes the connection to the backend, it has to be called before the other methods
+	Connect(ctx context.Context) error
+	// Publish sends a message to all servers, including this one
+	Publish(ctx context.Context, message *DistributionMessage) error
+	// Subscribe returns the messages of all servers until the context is done or the distributor is closed
+	Subscribe(ctx context.Context) (<-chan *DistributionMessage, error)
+	// Close releases the connection to the backend
+	Close() error
 }
 
+// DistributionMessage either carries a chat message, a moderation event or changed room settings
 type DistributionMessage struct {
-	Message  chat.Message `json:"message"`
-	ServerId string       `json:"server_id"`
+	Message      chat.Message     `json:"message"`
+	ServerId     string           `json:"server_id"`
+	Moderation   *ModerationEvent `json:"moderation,omitempty"`
+	RoomSettings *RoomSettings    `json:"room_settings,omitempty"`
 }
 
 // UnmarshalBinary a given byte array to a Message
@@ -45,47 +49,62 @@ func (distMsg DistributionMessage) MarshalBinary() ([]byte, error) {
 	return data, nil
 }
 
-// Ping connects a Distributor to the redis server
-func (distr *Distributor) Ping() error {
+// distributorFactories creates the distributor backends by their name, they read their configuration from env variables
+var distributorFactories = map[string]func() (Distributor, error){
+	"redis":         newRedisDistributor,
+	"redis-streams": newRedisStreamsDistributor,
+	"memory":        newMemoryDistributor,
+}
 
-	distr.client = *redis.NewClient(&redis.Options{
-		Addr:     distr.Server,
-		Password: distr.ServerPassword,
-		DB:       0,
-	})
+// RegisterDistributor makes a distributor backend available to the DIST_BACKEND configuration
+func RegisterDistributor(name string, factory func() (Distributor, error)) {
+	distributorFactories[name] = factory
+}
 
-	log.Println("Try to ping redis...")
-	err := distr.client.Ping(context.Background()).Err()
-	if err != nil {
-		log.Println("Pinging redis failed. Trying again in 3 seconds.")
-		time.Sleep(3 * time.Second)
-		err := distr.client.Ping(context.Background()).Err()
-		if err != nil {
-			return err
-		}
+// NewDistributor creates the distributor backend with the supplied name
+func NewDistributor(name string) (Distributor, error) {
+	factory, ok := distributorFactories[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown distributor backend: %v", name)
 	}
-	log.Println("Ping succeeded.")
+	return factory()
+}
 
-	distr.ctx = context.Background()
-	return nil
+// Distribution passes the messages of this server to the distributor and the messages of the other servers
+// to the broadcasting loop, the moderation and the room registry
+type Distribution struct {
+	Distributor Distributor
+	ServerId    string
+	Outgoing    <-chan *chat.Message
+	// Moderation receives the moderation events that have to be sent to the other servers
+	Moderation <-chan *ModerationEvent
+	// Rooms receives the changed room settings that have to be sent to the other servers
+	Rooms <-chan *RoomSettings
 }
 
-// Subscribe subscribes the Distributor to a topic
-func (distr *Distributor) Subscribe(serverId string) {
-	subscription := distr.client.Subscribe(distr.ctx, distr.Topic)
+// Subscribe passes the messages of the other servers on until the context is done
+func (distribution *Distribution) Subscribe(ctx context.Context) error {
+	messages, err := distribution.Distributor.Subscribe(ctx)
+	if err != nil {
+		return err
+	}
 
-	for msg := range subscription.Channel() {
+	for distMsg := range messages {
 		timer := prometheus.NewTimer(MessageProcessingTime)
 
 		MessageCounterVec.WithLabelValues("incoming_from_distributor").Inc()
 
-		var distMsg DistributionMessage
-		err := distMsg.UnmarshalBinary([]byte(msg.Payload))
-		if err != nil {
-			log.Panicln(err)
+		if distMsg.ServerId == distribution.ServerId {
+			continue
+		}
+
+		if distMsg.Moderation != nil {
+			moderation.Apply(distMsg.Moderation)
+			continue
 		}
 
-		if distMsg.ServerId == serverId {
+		if distMsg.RoomSettings != nil {
+			rooms.Apply(distMsg.RoomSettings)
 			continue
 		}
 
@@ -93,22 +112,39 @@ func (distr *Distributor) Subscribe(serverId string) {
 
 		incoming <- &wrapper
 	}
+	return nil
 }
 
-// Publish publishes MessageWrappers written in the outgoing channel
-func (distr *Distributor) Publish(serverId string) {
-	for message := range distr.Outgoing {
-
-		distMsg := DistributionMessage{
-			Message:  *message,
-			ServerId: serverId,
+// Publish publishes the messages written in the outgoing channel, the moderation events and the room settings
+// until the context is done
+func (distribution *Distribution) Publish(ctx context.Context) error {
+	for {
+		var distMsg DistributionMessage
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case message := <-distribution.Outgoing:
+			distMsg = DistributionMessage{
+				Message:  *message,
+				ServerId: distribution.ServerId,
+			}
+
+			MessageCounterVec.WithLabelValues("outgoing_to_distributor").Inc()
+		case event := <-distribution.Moderation:
+			distMsg = DistributionMessage{
+				ServerId:   distribution.ServerId,
+				Moderation: event,
+			}
+		case settings := <-distribution.Rooms:
+			distMsg = DistributionMessage{
+				ServerId:     distribution.ServerId,
+				RoomSettings: settings,
+			}
 		}
 
-		MessageCounterVec.WithLabelValues("outgoing_to_distributor").Inc()
-
-		err := distr.client.Publish(distr.ctx, distr.Topic, distMsg).Err()
+		err := distribution.Distributor.Publish(ctx, &distMsg)
 		if err != nil {
-			log.Fatal("Failed to publish distMsg via the distributor: ", err)
+			return err
 		}
 
 		log.Println("Sent a new distMsg via the distributor: ", distMsg)
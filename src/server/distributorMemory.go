@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+)
+
+// memoryTopics connects the memory distributors of this process by their topic
+var memoryTopics = struct {
+	subscriptions map[string][]*memorySubscription
+	mutex         sync.RWMutex
+}{subscriptions: make(map[string][]*memorySubscription)}
+
+// memorySubscription buffers the messages of a topic for a subscriber
+type memorySubscription struct {
+	messages chan *DistributionMessage
+	// done is closed once the subscriber stopped reading, so publishers do not block on it anymore
+	done chan struct{}
+}
+
+// MemoryDistributor exchanges the messages within the process. It is used by single servers and in tests,
+// where several distributors of the same topic act like the servers of a cluster.
+type MemoryDistributor struct {
+	Topic string
+	// BufferSize is the number of messages a subscription buffers before publishing blocks
+	BufferSize int
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// newMemoryDistributor reads the topic from DIST_TOPIC
+func newMemoryDistributor() (Distributor, error) {
+	return NewMemoryDistributor(os.Getenv("DIST_TOPIC"), messageBufferSize), nil
+}
+
+// NewMemoryDistributor creates a distributor that exchanges the messages of a topic within the process
+func NewMemoryDistributor(topic string, bufferSize int) *MemoryDistributor {
+	return &MemoryDistributor{Topic: topic, BufferSize: bufferSize, closed: make(chan struct{})}
+}
+
+// Connect does nothing, as the distributor needs no connection
+func (distr *MemoryDistributor) Connect(ctx context.Context) error {
+	return nil
+}
+
+// Publish passes the message to all subscriptions of the topic, it blocks while a subscription is full
+func (distr *MemoryDistributor) Publish(ctx context.Context, message *DistributionMessage) error {
+	memoryTopics.mutex.RLock()
+	defer memoryTopics.mutex.RUnlock()
+
+	for _, subscription := range memoryTopics.subscriptions[distr.Topic] {
+		// Every subscription receives its own copy, like the subscribers of a remote backend
+		distributed := *message
+		select {
+		case subscription.messages <- &distributed:
+		case <-subscription.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Subscribe returns the messages that are published to the topic until the context is done or the distributor is closed
+func (distr *MemoryDistributor) Subscribe(ctx context.Context) (<-chan *DistributionMessage, error) {
+	subscription := &memorySubscription{
+		messages: make(chan *DistributionMessage, distr.BufferSize),
+		done:     make(chan struct{}),
+	}
+
+	memoryTopics.mutex.Lock()
+	memoryTopics.subscriptions[distr.Topic] = append(memoryTopics.subscriptions[distr.Topic], subscription)
+	memoryTopics.mutex.Unlock()
+
+	messages := make(chan *DistributionMessage)
+	go func() {
+		defer close(messages)
+		defer distr.unsubscribe(subscription)
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-distr.closed:
+				return
+			case distMsg := <-subscription.messages:
+				select {
+				case messages <- distMsg:
+				case <-ctx.Done():
+					return
+				case <-distr.closed:
+					return
+				}
+			}
+		}
+	}()
+	return messages, nil
+}
+
+// Close ends the subscriptions of the distributor
+func (distr *MemoryDistributor) Close() error {
+	distr.closeOnce.Do(func() {
+		close(distr.closed)
+	})
+	return nil
+}
+
+// unsubscribe removes a subscription from its topic
+func (distr *MemoryDistributor) unsubscribe(subscription *memorySubscription) {
+	close(subscription.done)
+
+	memoryTopics.mutex.Lock()
+	defer memoryTopics.mutex.Unlock()
+
+	subscriptions := memoryTopics.subscriptions[distr.Topic]
+	for i, s := range subscriptions {
+		if s == subscription {
+			memoryTopics.subscriptions[distr.Topic] = append(subscriptions[:i:i], subscriptions[i+1:]...)
+			break
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"scale-chat/chat"
+	"testing"
+	"time"
+)
+
+// receive reads the supplied number of messages from a subscription
+func receive(t *testing.T, messages <-chan *DistributionMessage, count int) []*DistributionMessage {
+	t.Helper()
+
+	received := make([]*DistributionMessage, 0, count)
+	for len(received) < count {
+		select {
+		case distMsg, ok := <-messages:
+			if !ok {
+				t.Fatalf("subscription ended after %v of %v messages", len(received), count)
+			}
+			received = append(received, distMsg)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v of %v messages", len(received), count)
+		}
+	}
+	return received
+}
+
+// expectNothing fails if a message arrives within a short time
+func expectNothing(t *testing.T, messages <-chan *DistributionMessage) {
+	t.Helper()
+
+	select {
+	case distMsg, ok := <-messages:
+		if ok {
+			t.Fatalf("unexpected message %+v", distMsg)
+		}
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// expectClosed fails if the subscription does not end
+func expectClosed(t *testing.T, messages <-chan *DistributionMessage) {
+	t.Helper()
+
+	select {
+	case _, ok := <-messages:
+		if ok {
+			t.Fatal("got a message instead of the end of the subscription")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("subscription did not end")
+	}
+}
+
+// distributionMessages are the kinds of messages the servers exchange
+var distributionMessages = []struct {
+	name    string
+	message DistributionMessage
+}{
+	{"chat message", DistributionMessage{
+		ServerId: "server-a",
+		Message:  chat.Message{Id: "1", Text: "hello", Sender: "alice", Room: "lobby", SentAt: time.Unix(1700000000, 0).UTC()},
+	}},
+	{"moderation event", DistributionMessage{
+		ServerId:   "server-a",
+		Moderation: &ModerationEvent{Sanction: &Sanction{Id: "2", Kind: MuteSanction, Identity: "mallory"}},
+	}},
+	{"room settings", DistributionMessage{
+		ServerId:     "server-a",
+		RoomSettings: &RoomSettings{Name: "lobby", Topic: "news", Access: AccessPublic, DefaultRole: RoleMember, Roles: map[string]Role{"alice": RoleOwner}},
+	}},
+}
+
+func TestMemoryDistributorRoundTrip(t *testing.T) {
+	for _, test := range distributionMessages {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			// Two distributors of the same topic act like two servers, the publisher receives its own messages as well
+			var publisher, subscriber Distributor = NewMemoryDistributor(t.Name(), 10), NewMemoryDistributor(t.Name(), 10)
+			for _, distr := range []Distributor{publisher, subscriber} {
+				if err := distr.Connect(ctx); err != nil {
+					t.Fatal("cannot connect:", err)
+				}
+				defer distr.Close()
+			}
+
+			own, err := publisher.Subscribe(ctx)
+			if err != nil {
+				t.Fatal("cannot subscribe:", err)
+			}
+			other, err := subscriber.Subscribe(ctx)
+			if err != nil {
+				t.Fatal("cannot subscribe:", err)
+			}
+
+			sent := test.message
+			if err := publisher.Publish(ctx, &sent); err != nil {
+				t.Fatal("cannot publish:", err)
+			}
+
+			ownCopy, otherCopy := receive(t, own, 1)[0], receive(t, other, 1)[0]
+			for _, received := range []*DistributionMessage{ownCopy, otherCopy} {
+				if !reflect.DeepEqual(*received, test.message) {
+					t.Errorf("got %+v, want %+v", *received, test.message)
+				}
+				if received == &sent {
+					t.Error("the subscriber received the published message instead of a copy")
+				}
+			}
+			if ownCopy == otherCopy {
+				t.Error("the subscribers share the same message")
+			}
+		})
+	}
+}
+
+func TestMemoryDistributorTopics(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	lobby, news := NewMemoryDistributor(t.Name()+"-lobby", 10), NewMemoryDistributor(t.Name()+"-news", 10)
+	defer lobby.Close()
+	defer news.Close()
+
+	messages, err := news.Subscribe(ctx)
+	if err != nil {
+		t.Fatal("cannot subscribe:", err)
+	}
+
+	if err := lobby.Publish(ctx, &DistributionMessage{Message: chat.Message{Text: "hello"}}); err != nil {
+		t.Fatal("cannot publish:", err)
+	}
+	expectNothing(t, messages)
+}
+
+func TestMemoryDistributorEnds(t *testing.T) {
+	tests := []struct {
+		name string
+		stop func(cancel context.CancelFunc, distr Distributor)
+	}{
+		{"context done", func(cancel context.CancelFunc, _ Distributor) { cancel() }},
+		{"closed", func(_ context.CancelFunc, distr Distributor) { _ = distr.Close() }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			distr := NewMemoryDistributor(t.Name(), 1)
+			defer distr.Close()
+
+			messages, err := distr.Subscribe(ctx)
+			if err != nil {
+				t.Fatal("cannot subscribe:", err)
+			}
+
+			test.stop(cancel, distr)
+			expectClosed(t, messages)
+
+			// Publishing does not block on subscriptions that ended
+			publisher := NewMemoryDistributor(t.Name(), 1)
+			for i := 0; i < 3; i++ {
+				if err := publisher.Publish(context.Background(), &DistributionMessage{}); err != nil {
+					t.Fatal("cannot publish:", err)
+				}
+			}
+		})
+	}
+}
+
+func TestMemoryDistributorFactory(t *testing.T) {
+	t.Setenv("DIST_TOPIC", t.Name())
+
+	distr, err := NewDistributor("memory")
+	if err != nil {
+		t.Fatal("cannot create the memory distributor:", err)
+	}
+	if memory, ok := distr.(*MemoryDistributor); !ok || memory.Topic != t.Name() {
+		t.Errorf("got %+v, want a memory distributor of topic %v", distr, t.Name())
+	}
+
+	if _, err := NewDistributor("unknown"); err == nil {
+		t.Error("created an unknown backend")
+	}
+}
+
+func TestDistributionOverMemory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	previousRooms := rooms
+	rooms = NewRoomRegistry("", nil)
+	t.Cleanup(func() { rooms = previousRooms })
+
+	// Two servers share the topic, only the messages of the other server reach the broadcasting loop
+	outgoing := make(chan *chat.Message)
+	settings := make(chan *RoomSettings)
+	sender := &Distribution{Distributor: NewMemoryDistributor(t.Name(), 10), ServerId: "server-a", Outgoing: outgoing, Rooms: settings}
+	receiver := &Distribution{Distributor: NewMemoryDistributor(t.Name(), 10), ServerId: "server-b"}
+
+	for _, distribution := range []*Distribution{sender, receiver} {
+		distribution := distribution
+		defer distribution.Distributor.Close()
+		go func() { _ = distribution.Subscribe(ctx) }()
+	}
+	go func() { _ = sender.Publish(ctx) }()
+
+	// The subscriptions are registered asynchronously
+	time.Sleep(50 * time.Millisecond)
+
+	outgoing <- &chat.Message{Id: "1", Text: "hello", Room: "lobby"}
+
+	select {
+	case wrapper := <-incoming:
+		if wrapper.source != DISTRIBUTOR || wrapper.message.Id != "1" {
+			t.Errorf("got %+v from %v, want the message of server-a", wrapper.message, wrapper.source)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the message did not reach the broadcasting loop")
+	}
+
+	select {
+	case wrapper := <-incoming:
+		t.Fatalf("server-a received its own message %+v", wrapper.message)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	settings <- &RoomSettings{Name: "news", Topic: "distributed", UpdatedAt: time.Now()}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for rooms.Get("news").Topic != "distributed" {
+		if time.Now().After(deadline) {
+			t.Fatal("the room settings were not applied")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"os"
+	"time"
+)
+
+// RedisDistributor exchanges the messages via a Redis Pub/Sub channel. Messages that are published
+// while a server is disconnected are lost for that server.
+type RedisDistributor struct {
+	Server         string
+	ServerPassword string
+	Topic          string
+	client         *redis.Client
+}
+
+// newRedisDistributor reads the Redis server from DIST_SERVER and DIST_SERVER_PASSWORD and the channel from DIST_TOPIC
+func newRedisDistributor() (Distributor, error) {
+	return &RedisDistributor{
+		Server:         os.Getenv("DIST_SERVER"),
+		ServerPassword: os.Getenv("DIST_SERVER_PASSWORD"),
+		Topic:          os.Getenv("DIST_TOPIC"),
+	}, nil
+}
+
+// Connect creates the Redis client and pings the server, it tries again once after 3 seconds
+func (distr *RedisDistributor) Connect(ctx context.Context) error {
+	distr.client = redis.NewClient(&redis.Options{
+		Addr:     distr.Server,
+		Password: distr.ServerPassword,
+		DB:       0,
+	})
+
+	return pingRedis(ctx, distr.client)
+}
+
+// Publish publishes the message to the channel
+func (distr *RedisDistributor) Publish(ctx context.Context, message *DistributionMessage) error {
+	return distr.client.Publish(ctx, distr.Topic, message).Err()
+}
+
+// Subscribe subscribes to the channel and decodes its messages, messages that cannot be decoded are skipped
+func (distr *RedisDistributor) Subscribe(ctx context.Context) (<-chan *DistributionMessage, error) {
+	subscription := distr.client.Subscribe(ctx, distr.Topic)
+
+	// Wait for the confirmation, so no message published afterwards is missed
+	_, err := subscription.Receive(ctx)
+	if err != nil {
+		_ = subscription.Close()
+		return nil, err
+	}
+
+	messages := make(chan *DistributionMessage)
+	go func() {
+		defer close(messages)
+		defer subscription.Close()
+
+		channel := subscription.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-channel:
+				if !ok {
+					return
+				}
+
+				var distMsg DistributionMessage
+				if distMsg.UnmarshalBinary([]byte(msg.Payload)) != nil {
+					continue
+				}
+
+				select {
+				case messages <- &distMsg:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return messages, nil
+}
+
+// Close closes the Redis client, which ends the subscriptions as well
+func (distr *RedisDistributor) Close() error {
+	if distr.client == nil {
+		return nil
+	}
+	return distr.client.Close()
+}
+
+// pingRedis checks the connection to the Redis server, it tries again once after 3 seconds
+func pingRedis(ctx context.Context, client *redis.Client) error {
+	log.Println("Try to ping redis...")
+	err := client.Ping(ctx).Err()
+	if err != nil {
+		log.Println("Pinging redis failed. Trying again in 3 seconds.")
+		time.Sleep(3 * time.Second)
+		err := client.Ping(ctx).Err()
+		if err != nil {
+			return err
+		}
+	}
+	log.Println("Ping succeeded.")
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-redis/redis/v8"
+	"log"
+	"math"
+	"os"
+	"scale-chat/chat"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Stream modes of the Redis Streams distributor, see DIST_STREAM_MODE
+const (
+	// GlobalStreams appends all messages to a single stream
+	GlobalStreams = "global"
+	// RoomStreams appends the chat messages of every room to its own stream and all other messages to the global stream
+	RoomStreams = "room"
+)
+
+// streamReadCount is the maximum number of entries that are read at once
+const streamReadCount = 100
+
+// RedisStreamsDistributor exchanges the messages via Redis Streams. Every server reads the streams with its own
+// consumer group, so it resumes from the last entry it read after a reconnect or a restart.
+type RedisStreamsDistributor struct {
+	Server         string
+	ServerPassword string
+	// Topic is the key of the global stream and the prefix of the room streams
+	Topic string
+	Mode  string
+	// Group is the consumer group of this server, it has to stay the same across restarts to resume reading
+	Group string
+	// MaxLen and MaxAge trim the streams, 0 disables the trimming
+	MaxLen int64
+	MaxAge time.Duration
+	// Refresh is how often new room streams are looked up, the streams are trimmed by age and the lag is measured
+	Refresh time.Duration
+	client  *redis.Client
+}
+
+// newRedisStreamsDistributor reads the Redis server from DIST_SERVER and DIST_SERVER_PASSWORD, the streams from
+// DIST_TOPIC and DIST_STREAM_MODE, the consumer group from DIST_STREAM_GROUP and the trimming from
+// DIST_STREAM_MAX_LEN and DIST_STREAM_MAX_AGE
+func newRedisStreamsDistributor() (Distributor, error) {
+	distr := &RedisStreamsDistributor{
+		Server:         os.Getenv("DIST_SERVER"),
+		ServerPassword: os.Getenv("DIST_SERVER_PASSWORD"),
+		Topic:          os.Getenv("DIST_TOPIC"),
+		Mode:           os.Getenv("DIST_STREAM_MODE"),
+		Group:          os.Getenv("DIST_STREAM_GROUP"),
+		MaxLen:         int64(getEnvInt("DIST_STREAM_MAX_LEN", 10000)),
+		MaxAge:         getEnvDuration("DIST_STREAM_MAX_AGE", 0),
+		Refresh:        getEnvDuration("DIST_STREAM_REFRESH", 5*time.Second),
+	}
+
+	if distr.Topic == "" {
+		distr.Topic = "scale-chat"
+	}
+	if distr.Mode == "" {
+		distr.Mode = GlobalStreams
+	}
+	if distr.Mode != GlobalStreams && distr.Mode != RoomStreams {
+		return nil, fmt.Errorf("unknown stream mode: %v", distr.Mode)
+	}
+	if distr.Refresh <= 0 {
+		distr.Refresh = 5 * time.Second
+	}
+
+	// The host name survives a restart of the process or container, unlike the server id. A recreated container gets a
+	// new host name though, so its new group skips the entries of the outage and the pending entries of the old group
+	// are never acknowledged.
+	if distr.Group == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("cannot determine the consumer group, set DIST_STREAM_GROUP: %w", err)
+		}
+		log.Printf("DIST_STREAM_GROUP is not set, consumer group %v does not replay missed entries if the host name changes", hostname)
+		distr.Group = hostname
+	}
+	return distr, nil
+}
+
+// Connect creates the Redis client and pings the server, it tries again once after 3 seconds
+func (distr *RedisStreamsDistributor) Connect(ctx context.Context) error {
+	distr.client = redis.NewClient(&redis.Options{
+		Addr:     distr.Server,
+		Password: distr.ServerPassword,
+		DB:       0,
+	})
+
+	log.Printf("Reading the streams of %v as consumer group %v", distr.Topic, distr.Group)
+	return pingRedis(ctx, distr.client)
+}
+
+// roomsKey is the set of the room streams
+func (distr *RedisStreamsDistributor) roomsKey() string {
+	return distr.Topic + ":rooms"
+}
+
+// streamOf returns the stream a message is appended to
+func (distr *RedisStreamsDistributor) streamOf(message *DistributionMessage) string {
+	room := message.Message.Room
+	if distr.Mode != RoomStreams || message.Moderation != nil || message.RoomSettings != nil ||
+		room == "" || room == chat.AllRooms {
+		return distr.Topic
+	}
+	return distr.Topic + ":room:" + room
+}
+
+// Publish appends the message to its stream and trims the stream to its maximum length
+func (distr *RedisStreamsDistributor) Publish(ctx context.Context, message *DistributionMessage) error {
+	stream := distr.streamOf(message)
+
+	pipe := distr.client.Pipeline()
+	if stream != distr.Topic {
+		pipe.SAdd(ctx, distr.roomsKey(), stream)
+	}
+	pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: stream,
+		MaxLen: distr.MaxLen,
+		Approx: true,
+		Values: []interface{}{"message", message},
+	})
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// Subscribe reads the streams with the consumer group of this server. Entries that were read but not acknowledged
+// before are delivered first. Groups that do not exist yet start with the entries appended after this call.
+func (distr *RedisStreamsDistributor) Subscribe(ctx context.Context) (<-chan *DistributionMessage, error) {
+	reader := &streamReader{
+		distr:  distr,
+		start:  lastStreamIDBefore(time.Now()),
+		joined: make(map[string]bool),
+	}
+
+	if err := reader.join(ctx); err != nil {
+		return nil, err
+	}
+
+	messages := make(chan *DistributionMessage)
+	go reader.read(ctx, messages)
+	return messages, nil
+}
+
+// Close closes the Redis client, which ends the subscriptions as well
+func (distr *RedisStreamsDistributor) Close() error {
+	if distr.client == nil {
+		return nil
+	}
+	return distr.client.Close()
+}
+
+// streamReader reads the streams of a subscription, it is only used by the goroutine of the subscription
+type streamReader struct {
+	distr *RedisStreamsDistributor
+	// start is the id new consumer groups start after
+	start string
+	// joined holds the streams the consumer group was created for
+	joined    map[string]bool
+	streams   []string
+	refreshed time.Time
+}
+
+// join creates the consumer group for the streams that were added since the last call
+func (reader *streamReader) join(ctx context.Context) error {
+	distr := reader.distr
+
+	streams := []string{distr.Topic}
+	if distr.Mode == RoomStreams {
+		rooms, err := distr.client.SMembers(ctx, distr.roomsKey()).Result()
+		if err != nil {
+			return err
+		}
+		streams = append(streams, rooms...)
+	}
+
+	for _, stream := range streams {
+		if reader.joined[stream] {
+			continue
+		}
+
+		err := distr.client.XGroupCreateMkStream(ctx, stream, distr.Group, reader.start).Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+		reader.joined[stream] = true
+	}
+
+	reader.streams = streams
+	reader.refreshed = time.Now()
+	return nil
+}
+
+// read passes the entries of the streams to the channel and acknowledges them until the context is done.
+// After an error it reconnects and delivers the unacknowledged entries again.
+func (reader *streamReader) read(ctx context.Context, messages chan<- *DistributionMessage) {
+	defer close(messages)
+	distr := reader.distr
+
+	pending := true
+	for ctx.Err() == nil {
+		if time.Since(reader.refreshed) >= distr.Refresh {
+			if err := reader.join(ctx); err != nil {
+				reader.fail(ctx, err)
+				pending = true
+				continue
+			}
+			reader.maintain(ctx)
+		}
+
+		// "0" reads the entries that were delivered to this group but not acknowledged, ">" reads new entries
+		id := ">"
+		if pending {
+			id = "0"
+		}
+		args := make([]string, 0, 2*len(reader.streams))
+		args = append(args, reader.streams...)
+		for range reader.streams {
+			args = append(args, id)
+		}
+
+		result, err := distr.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+			Group:    distr.Group,
+			Consumer: distr.Group,
+			Streams:  args,
+			Count:    streamReadCount,
+			Block:    distr.Refresh,
+		}).Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			reader.fail(ctx, err)
+			pending = true
+			continue
+		}
+
+		delivered := 0
+		for _, stream := range result {
+			for _, entry := range stream.Messages {
+				if !reader.deliver(ctx, entry, messages) {
+					return
+				}
+				// The entry was passed on, so it is acknowledged even if the subscription ends meanwhile.
+				// Entries that are not acknowledged are delivered again after a reconnect.
+				if err := distr.client.XAck(context.Background(), stream.Stream, distr.Group, entry.ID).Err(); err != nil {
+					DistributorAckErrorsCounter.Inc()
+					log.Printf("Cannot acknowledge entry %v of stream %v: %v", entry.ID, stream.Stream, err)
+				}
+			}
+			delivered += len(stream.Messages)
+		}
+
+		if pending && delivered == 0 {
+			pending = false
+		}
+	}
+}
+
+// deliver decodes an entry and passes it to the channel, entries that cannot be decoded are skipped.
+// It returns false if the context is done.
+func (reader *streamReader) deliver(ctx context.Context, entry redis.XMessage, messages chan<- *DistributionMessage) bool {
+	payload, _ := entry.Values["message"].(string)
+
+	var distMsg DistributionMessage
+	if distMsg.UnmarshalBinary([]byte(payload)) != nil {
+		return true
+	}
+
+	select {
+	case messages <- &distMsg:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// fail logs the error and waits a second before the streams are joined again, as they might have been lost
+func (reader *streamReader) fail(ctx context.Context, err error) {
+	if ctx.Err() != nil {
+		return
+	}
+	log.Println("Cannot read the distribution streams, trying again in a second:", err)
+
+	reader.joined = make(map[string]bool)
+	reader.refreshed = time.Time{}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+	}
+}
+
+// maintain trims the streams by age and measures the lag of the consumer group
+func (reader *streamReader) maintain(ctx context.Context) {
+	distr := reader.distr
+
+	// XINFO is read as plain replies, as the fields differ between the versions of Redis
+	pipe := distr.client.Pipeline()
+	infos := make([]*redis.Cmd, len(reader.streams))
+	groups := make([]*redis.Cmd, len(reader.streams))
+	for i, stream := range reader.streams {
+		if distr.MaxAge > 0 {
+			pipe.XTrimMinIDApprox(ctx, stream, streamID(time.Now().Add(-distr.MaxAge)), 0)
+		}
+		infos[i] = pipe.Do(ctx, "xinfo", "stream", stream)
+		groups[i] = pipe.Do(ctx, "xinfo", "groups", stream)
+	}
+	_, err := pipe.Exec(ctx)
+	if err != nil {
+		log.Println("Cannot measure the lag of the distribution streams:", err)
+		return
+	}
+
+	var lag time.Duration
+	var pending int64
+	for i := range reader.streams {
+		last := streamTime(replyFields(infos[i].Val())["last-generated-id"])
+		groupReplies, _ := groups[i].Val().([]interface{})
+		for _, groupReply := range groupReplies {
+			group := replyFields(groupReply)
+			if group["name"] != distr.Group {
+				continue
+			}
+			if behind := last.Sub(streamTime(group["last-delivered-id"])); behind > lag {
+				lag = behind
+			}
+			count, _ := group["pending"].(int64)
+			pending += count
+		}
+	}
+
+	DistributorLagGauge.Set(lag.Seconds())
+	DistributorPendingGauge.Set(float64(pending))
+}
+
+// replyFields maps the names of a reply of alternating names and values to their values
+func replyFields(reply interface{}) map[string]interface{} {
+	values, _ := reply.([]interface{})
+	fields := make(map[string]interface{}, len(values)/2)
+	for i := 0; i+1 < len(values); i += 2 {
+		if name, ok := values[i].(string); ok {
+			fields[name] = values[i+1]
+		}
+	}
+	return fields
+}
+
+// streamID returns the smallest stream id of the time
+func streamID(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond), 10) + "-0"
+}
+
+// lastStreamIDBefore returns the largest stream id of the millisecond before the time, so the entries that are
+// appended within the millisecond of the time come after it
+func lastStreamIDBefore(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano()/int64(time.Millisecond)-1, 10) + "-" + strconv.FormatUint(math.MaxUint64, 10)
+}
+
+// streamTime returns the time an entry was appended from its id
+func streamTime(id interface{}) time.Time {
+	text, _ := id.(string)
+	millis, _ := strconv.ParseInt(strings.SplitN(text, "-", 2)[0], 10, 64)
+	return time.Unix(0, millis*int64(time.Millisecond))
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"os"
+	"reflect"
+	"scale-chat/chat"
+	"testing"
+	"time"
+)
+
+// newTestStreams connects a streams distributor to the Redis server of TEST_REDIS_SERVER, the test is skipped
+// if it is not set. Every test uses its own topic.
+func newTestStreams(t *testing.T, topic string, mode string, group string) *RedisStreamsDistributor {
+	t.Helper()
+
+	server := os.Getenv("TEST_REDIS_SERVER")
+	if server == "" {
+		t.Skip("TEST_REDIS_SERVER is not set")
+	}
+
+	distr := &RedisStreamsDistributor{
+		Server:  server,
+		Topic:   topic,
+		Mode:    mode,
+		Group:   group,
+		MaxLen:  1000,
+		Refresh: 100 * time.Millisecond,
+	}
+	if err := distr.Connect(context.Background()); err != nil {
+		t.Fatal("cannot connect to Redis:", err)
+	}
+	t.Cleanup(func() { _ = distr.Close() })
+	return distr
+}
+
+// testTopic returns a topic that is not used by other tests
+func testTopic() string {
+	return "scale-chat-test-" + uuid.New().String()
+}
+
+// chatMessage creates a distribution message of a chat message
+func chatMessage(id string, room string) *DistributionMessage {
+	return &DistributionMessage{ServerId: "server-a", Message: chat.Message{Id: id, Text: "text " + id, Room: room}}
+}
+
+// messageIds returns the ids of the chat messages
+func messageIds(messages []*DistributionMessage) []string {
+	ids := make([]string, 0, len(messages))
+	for _, distMsg := range messages {
+		ids = append(ids, distMsg.Message.Id)
+	}
+	return ids
+}
+
+func TestStreamOf(t *testing.T) {
+	tests := []struct {
+		name    string
+		mode    string
+		message DistributionMessage
+		stream  string
+	}{
+		{"global chat message", GlobalStreams, DistributionMessage{Message: chat.Message{Room: "lobby"}}, "chat"},
+		{"room chat message", RoomStreams, DistributionMessage{Message: chat.Message{Room: "lobby"}}, "chat:room:lobby"},
+		{"default room", RoomStreams, DistributionMessage{}, "chat"},
+		{"all rooms", RoomStreams, DistributionMessage{Message: chat.Message{Room: chat.AllRooms}}, "chat"},
+		{"moderation event", RoomStreams, DistributionMessage{Message: chat.Message{Room: "lobby"}, Moderation: &ModerationEvent{}}, "chat"},
+		{"room settings", RoomStreams, DistributionMessage{RoomSettings: &RoomSettings{Name: "lobby"}}, "chat"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			distr := &RedisStreamsDistributor{Topic: "chat", Mode: test.mode}
+			if stream := distr.streamOf(&test.message); stream != test.stream {
+				t.Errorf("got stream %v, want %v", stream, test.stream)
+			}
+		})
+	}
+}
+
+func TestStreamIDs(t *testing.T) {
+	at := time.Unix(1700000000, 123000000)
+
+	if id := streamID(at); id != "1700000000123-0" {
+		t.Errorf("got id %v, want 1700000000123-0", id)
+	}
+	if id := lastStreamIDBefore(at); id != "1700000000122-18446744073709551615" {
+		t.Errorf("got id %v, want the last id of the previous millisecond", id)
+	}
+
+	tests := []struct {
+		id   interface{}
+		time time.Time
+	}{
+		{"1700000000123-0", at},
+		{"1700000000123-42", at},
+		{"1700000000123", at},
+		{"", time.Unix(0, 0)},
+		{nil, time.Unix(0, 0)},
+	}
+	for _, test := range tests {
+		if got := streamTime(test.id); !got.Equal(test.time) {
+			t.Errorf("streamTime(%v) = %v, want %v", test.id, got, test.time)
+		}
+	}
+}
+
+func TestReplyFields(t *testing.T) {
+	reply := []interface{}{"name", "server-a", "pending", int64(2), "last-delivered-id", "1-0", "dangling"}
+	want := map[string]interface{}{"name": "server-a", "pending": int64(2), "last-delivered-id": "1-0"}
+
+	if fields := replyFields(reply); !reflect.DeepEqual(fields, want) {
+		t.Errorf("got %v, want %v", fields, want)
+	}
+	if fields := replyFields("not a list"); len(fields) != 0 {
+		t.Errorf("got %v for a reply that is no list", fields)
+	}
+}
+
+func TestRedisStreamsRoundTrip(t *testing.T) {
+	for _, mode := range []string{GlobalStreams, RoomStreams} {
+		t.Run(mode, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			topic := testTopic()
+			distr := newTestStreams(t, topic, mode, "server-a")
+
+			messages, err := distr.Subscribe(ctx)
+			if err != nil {
+				t.Fatal("cannot subscribe:", err)
+			}
+
+			sent := []*DistributionMessage{
+				chatMessage("1", "lobby"),
+				{ServerId: "server-a", Moderation: &ModerationEvent{Revoked: "2"}},
+				{ServerId: "server-a", RoomSettings: &RoomSettings{Name: "lobby", Topic: "news", Roles: map[string]Role{}}},
+			}
+			for _, distMsg := range sent {
+				if err := distr.Publish(ctx, distMsg); err != nil {
+					t.Fatal("cannot publish:", err)
+				}
+			}
+
+			// Room streams are picked up with the next refresh, so the order of the streams is not fixed
+			received := receive(t, messages, len(sent))
+			for _, want := range sent {
+				found := false
+				for _, got := range received {
+					found = found || reflect.DeepEqual(got, want)
+				}
+				if !found {
+					t.Errorf("did not receive %+v", want)
+				}
+			}
+		})
+	}
+}
+
+func TestRedisStreamsConsumerGroups(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	topic := testTopic()
+	publisher := newTestStreams(t, topic, GlobalStreams, "server-a")
+
+	// Every server reads with its own group, so each of them receives all messages
+	var subscriptions []<-chan *DistributionMessage
+	for _, group := range []string{"server-a", "server-b"} {
+		messages, err := newTestStreams(t, topic, GlobalStreams, group).Subscribe(ctx)
+		if err != nil {
+			t.Fatal("cannot subscribe:", err)
+		}
+		subscriptions = append(subscriptions, messages)
+	}
+
+	for _, id := range []string{"1", "2", "3"} {
+		if err := publisher.Publish(ctx, chatMessage(id, "lobby")); err != nil {
+			t.Fatal("cannot publish:", err)
+		}
+	}
+
+	for i, messages := range subscriptions {
+		if ids := messageIds(receive(t, messages, 3)); !reflect.DeepEqual(ids, []string{"1", "2", "3"}) {
+			t.Errorf("group %v received %v", i, ids)
+		}
+		expectNothing(t, messages)
+	}
+}
+
+func TestRedisStreamsReplay(t *testing.T) {
+	tests := []struct {
+		name string
+		// before runs while the first subscription is active
+		before func(ctx context.Context, t *testing.T, distr *RedisStreamsDistributor, messages <-chan *DistributionMessage)
+		// missed are published after the first subscription ended
+		missed []string
+		// replayed are the ids the second subscription of the group receives
+		replayed []string
+	}{
+		{
+			name: "entries appended while disconnected",
+			before: func(ctx context.Context, t *testing.T, distr *RedisStreamsDistributor, messages <-chan *DistributionMessage) {
+				if err := distr.Publish(ctx, chatMessage("1", "lobby")); err != nil {
+					t.Fatal("cannot publish:", err)
+				}
+				receive(t, messages, 1)
+			},
+			missed:   []string{"2", "3"},
+			replayed: []string{"2", "3"},
+		},
+		{
+			name: "entries read but not acknowledged",
+			before: func(ctx context.Context, t *testing.T, distr *RedisStreamsDistributor, _ <-chan *DistributionMessage) {
+				// The entries are read from the stream, but nobody takes them from the channel before the subscription ends
+				for _, id := range []string{"1", "2"} {
+					if err := distr.Publish(ctx, chatMessage(id, "lobby")); err != nil {
+						t.Fatal("cannot publish:", err)
+					}
+				}
+				time.Sleep(300 * time.Millisecond)
+			},
+			missed:   []string{"3"},
+			replayed: []string{"1", "2", "3"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			topic := testTopic()
+			distr := newTestStreams(t, topic, GlobalStreams, "server-a")
+
+			ctx, cancel := context.WithCancel(context.Background())
+			messages, err := distr.Subscribe(ctx)
+			if err != nil {
+				t.Fatal("cannot subscribe:", err)
+			}
+			test.before(ctx, t, distr, messages)
+			cancel()
+			for range messages {
+			}
+
+			publisher := newTestStreams(t, topic, GlobalStreams, "publisher")
+			for _, id := range test.missed {
+				if err := publisher.Publish(context.Background(), chatMessage(id, "lobby")); err != nil {
+					t.Fatal("cannot publish:", err)
+				}
+			}
+
+			// The group resumes after a restart with the entries it did not acknowledge and the ones it missed
+			ctx, cancel = context.WithCancel(context.Background())
+			defer cancel()
+			messages, err = newTestStreams(t, topic, GlobalStreams, "server-a").Subscribe(ctx)
+			if err != nil {
+				t.Fatal("cannot subscribe again:", err)
+			}
+
+			if ids := messageIds(receive(t, messages, len(test.replayed))); !reflect.DeepEqual(ids, test.replayed) {
+				t.Errorf("got %v after the restart, want %v", ids, test.replayed)
+			}
+			expectNothing(t, messages)
+		})
+	}
+}
+
+func TestRedisStreamsNewGroupSkipsHistory(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	topic := testTopic()
+	publisher := newTestStreams(t, topic, GlobalStreams, "publisher")
+	if err := publisher.Publish(ctx, chatMessage("old", "lobby")); err != nil {
+		t.Fatal("cannot publish:", err)
+	}
+
+	// The stream ids have millisecond precision
+	time.Sleep(10 * time.Millisecond)
+
+	messages, err := newTestStreams(t, topic, GlobalStreams, "server-new").Subscribe(ctx)
+	if err != nil {
+		t.Fatal("cannot subscribe:", err)
+	}
+	if err := publisher.Publish(ctx, chatMessage("new", "lobby")); err != nil {
+		t.Fatal("cannot publish:", err)
+	}
+
+	if ids := messageIds(receive(t, messages, 1)); !reflect.DeepEqual(ids, []string{"new"}) {
+		t.Errorf("a new group received %v, want only the new message", ids)
+	}
+}
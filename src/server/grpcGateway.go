@@ -0,0 +1,273 @@
+package main
+
+import (
+	"context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"log"
+	"net"
+	"scale-chat/chat"
+	"scale-chat/chatpb"
+	"sync"
+	"time"
+)
+
+// chatService implements the gRPC Chat service on top of the room registry and the broadcasting loop
+type chatService struct {
+	chatpb.UnimplementedChatServer
+}
+
+// grpcConn exchanges messages via a bidirectional Chat stream
+type grpcConn struct {
+	stream chatpb.Chat_ChatServer
+	room   string
+	// pending is the message of the first request, which is returned by the first ReadMessage call
+	pending *chat.Message
+	// received passes the requests of the stream, so ReadMessage can return as soon as the connection is closed
+	received  chan grpcReceived
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// grpcReceived is a request of the stream or the error that ended it
+type grpcReceived struct {
+	request *chatpb.ChatRequest
+	err     error
+}
+
+// ListenGRPC serves the gRPC Chat service on the supplied address
+func ListenGRPC(address string) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal("Could not listen on gRPC port: ", err)
+	}
+
+	server := grpc.NewServer()
+	chatpb.RegisterChatServer(server, &chatService{})
+
+	log.Println("gRPC server will be listening for incoming requests on:", address)
+
+	if err := server.Serve(l); err != nil {
+		log.Fatal("Serving the gRPC server failed:", err)
+	}
+}
+
+// Chat registers the stream as client of the room selected by the first request
+func (service *chatService) Chat(stream chatpb.Chat_ChatServer) error {
+	log.Println("Got new gRPC stream")
+
+	request, err := stream.Recv()
+	if err != nil {
+		return err
+	}
+
+	verified, err := grpcIdentity(stream.Context())
+	if err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	identity := request.GetIdentity()
+	if identity == "" {
+		identity = verified
+	}
+	if err := claimIdentity(identity, verified); err != nil {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	err = rooms.Admit(request.GetRoom(), identity, verified != "" && identity == verified, request.GetPassword())
+	if err != nil {
+		return admissionError(err)
+	}
+
+	conn := &grpcConn{
+		stream:   stream,
+		room:     request.GetRoom(),
+		received: make(chan grpcReceived),
+		closed:   make(chan struct{}),
+	}
+
+	err = limiter.Acquire(hostOf(conn.RemoteAddr()), request.GetRoom())
+	if err != nil {
+		return status.Error(codes.ResourceExhausted, err.Error())
+	}
+
+	client := NewClient(conn, request.GetRoom(), request.GetThread(), identity, verified)
+
+	// The first request may already carry a message, it is processed like the following ones once the client runs
+	if request.GetMessage() != nil {
+		conn.pending = conn.toMessage(request.GetMessage())
+	}
+
+	// The receiving goroutine is blocked in Recv until the handler returned
+	go conn.receive()
+
+	// Run returns once the stream broke or the server closed the connection, e.g. because the client was kicked
+	client.Run()
+
+	return nil
+}
+
+// Send passes a single message to the broadcasting loop and returns its id
+func (service *chatService) Send(ctx context.Context, request *chatpb.SendRequest) (*chatpb.SendResponse, error) {
+	if request.GetMessage() == nil {
+		return nil, status.Error(codes.InvalidArgument, "message is missing")
+	}
+
+	message := chat.MessageFromProto(request.GetMessage())
+	if request.GetMessage().GetSentAt() == nil {
+		message.SentAt = time.Now()
+	}
+
+	// Calls with an identity token always send in the name of the verified identity
+	verified, err := grpcIdentity(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	if verified != "" {
+		message.Sender = verified
+	} else if err := claimIdentity(message.Sender, ""); err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	// The address includes the port, so it identifies the client's connection
+	ip, session := "", ""
+	if p, ok := peer.FromContext(ctx); ok {
+		ip, session = hostOf(p.Addr.String()), p.Addr.String()
+	}
+	for _, kind := range []string{BanSanction, MuteSanction} {
+		if sanction := moderation.Find(kind, message.Sender, ip, message.Room); sanction != nil {
+			return nil, status.Error(codes.PermissionDenied, sanctionNotice(sanction))
+		}
+	}
+
+	if err := rooms.Admit(message.Room, message.Sender, verified != "", request.GetPassword()); err != nil {
+		return nil, admissionError(err)
+	}
+
+	if err := authorize(message.Sender, verified != "", &message); err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+
+	id, err := SubmitMessage(&MessageContext{Identity: message.Sender, Authenticated: verified != "", IP: ip, Session: session}, &message, incoming)
+	if err != nil {
+		return nil, status.Error(codes.FailedPrecondition, err.Error())
+	}
+
+	return &chatpb.SendResponse{Id: id}, nil
+}
+
+// History returns the latest messages of a room
+func (service *chatService) History(ctx context.Context, request *chatpb.HistoryRequest) (*chatpb.HistoryResponse, error) {
+	verified, err := grpcIdentity(ctx)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	identity := request.GetIdentity()
+	if identity == "" {
+		identity = verified
+	}
+
+	err = rooms.Admit(request.GetRoom(), identity, verified != "" && identity == verified, request.GetPassword())
+	if err != nil {
+		return nil, admissionError(err)
+	}
+
+	messages := history.Latest(request.GetRoom(), int(request.GetLimit()))
+
+	response := &chatpb.HistoryResponse{Messages: make([]*chatpb.Message, 0, len(messages))}
+	for i := range messages {
+		response.Messages = append(response.Messages, messages[i].ToProto())
+	}
+
+	return response, nil
+}
+
+// admissionError converts the reason why a user may not join a room to a gRPC status
+func admissionError(err error) error {
+	if err == errWrongPassword {
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	return status.Error(codes.PermissionDenied, err.Error())
+}
+
+// receive passes the requests of the stream to ReadMessage until the stream breaks or the connection is closed
+func (conn *grpcConn) receive() {
+	for {
+		request, err := conn.stream.Recv()
+
+		select {
+		case conn.received <- grpcReceived{request: request, err: err}:
+		case <-conn.closed:
+			return
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// ReadMessage returns the next message of the stream and skips requests without message.
+// It returns an error once the stream broke or the connection was closed.
+func (conn *grpcConn) ReadMessage() (*chat.Message, error) {
+	if conn.pending != nil {
+		message := conn.pending
+		conn.pending = nil
+		return message, nil
+	}
+
+	for {
+		select {
+		case <-conn.closed:
+			return nil, errConnClosed
+		case received := <-conn.received:
+			if received.err != nil {
+				return nil, received.err
+			}
+
+			if received.request.GetMessage() == nil {
+				continue
+			}
+
+			return conn.toMessage(received.request.GetMessage()), nil
+		}
+	}
+}
+
+func (conn *grpcConn) WriteMessage(message *chat.Message) error {
+	return conn.stream.Send(message.ToProto())
+}
+
+// Close lets ReadMessage return, so the client stops and the Chat handler returns, which closes the stream
+func (conn *grpcConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+	return nil
+}
+
+func (conn *grpcConn) Transport() string {
+	return "grpc"
+}
+
+// toMessage converts a message of the stream and completes the room and timestamp if they are missing
+func (conn *grpcConn) toMessage(pbMsg *chatpb.Message) *chat.Message {
+	message := chat.MessageFromProto(pbMsg)
+	if message.Room == "" {
+		message.Room = conn.room
+	}
+	if pbMsg.GetSentAt() == nil {
+		message.SentAt = time.Now()
+	}
+	return &message
+}
+
+// RemoteAddr returns the address of the stream's peer
+func (conn *grpcConn) RemoteAddr() string {
+	p, ok := peer.FromContext(conn.stream.Context())
+	if !ok {
+		return ""
+	}
+	return p.Addr.String()
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"scale-chat/chat"
+	"sync"
+	"time"
+)
+
+// defaultHistorySize is the number of messages that are kept per room
+const defaultHistorySize = 1000
+
+// History keeps the latest messages of each room in memory and tracks the threads they belong to.
+// The stored messages are copies, so they can be updated without racing with the outgoing handlers.
+type History struct {
+	mutex    sync.RWMutex
+	size     int
+	rooms    map[string][]*chat.Message
+	messages map[string]*chat.Message
+	replies  map[string][]*chat.Message
+}
+
+// history of all rooms that is filled by the broadcasting loop
+var history = NewHistory(defaultHistorySize)
+
+// NewHistory creates a History that keeps up to size messages per room
+func NewHistory(size int) *History {
+	return &History{
+		size:     size,
+		rooms:    make(map[string][]*chat.Message),
+		messages: make(map[string]*chat.Message),
+		replies:  make(map[string][]*chat.Message),
+	}
+}
+
+// Add stores a copy of the message. Replies to a reply are attached to the root of the thread and replies to a message
+// of another room are stored as regular messages, therefore the ParentId of the supplied message might be changed.
+// If the message is a reply, the update of its thread's summary is returned.
+func (history *History) Add(message *chat.Message) *chat.Message {
+	if message.Id == "" {
+		return nil
+	}
+
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	if message.ParentId != "" {
+		if parent, ok := history.messages[message.ParentId]; ok && parent.Room != message.Room {
+			message.ParentId = ""
+		} else if ok && parent.ParentId != "" {
+			message.ParentId = parent.ParentId
+		}
+	}
+
+	stored := *message
+	stored.Thread = nil
+
+	roomMessages := append(history.rooms[stored.Room], &stored)
+	if len(roomMessages) > history.size {
+		history.evict(roomMessages[0])
+		roomMessages = roomMessages[1:]
+	}
+	history.rooms[stored.Room] = roomMessages
+	history.messages[stored.Id] = &stored
+
+	if stored.ParentId == "" {
+		return nil
+	}
+
+	parent, ok := history.messages[stored.ParentId]
+	if !ok || parent.Room != stored.Room {
+		return nil
+	}
+
+	history.replies[parent.Id] = append(history.replies[parent.Id], &stored)
+
+	summary := chat.ThreadSummary{}
+	if parent.Thread != nil {
+		summary = *parent.Thread
+	}
+	summary.ReplyCount++
+	summary.LastReplyId = stored.Id
+	summary.LastReplySender = stored.Sender
+	summary.LastReplyAt = stored.SentAt
+	parent.Thread = &summary
+
+	return threadUpdate(parent)
+}
+
+// Thread returns copies of a thread's parent message and its replies
+func (history *History) Thread(room string, parentId string) (*chat.Message, []chat.Message, bool) {
+	history.mutex.RLock()
+	defer history.mutex.RUnlock()
+
+	parent, ok := history.messages[parentId]
+	if !ok || parent.Room != room {
+		return nil, nil, false
+	}
+
+	parentCopy := *parent
+	if parent.Thread != nil {
+		summary := *parent.Thread
+		parentCopy.Thread = &summary
+	}
+
+	replies := make([]chat.Message, 0, len(history.replies[parentId]))
+	for _, reply := range history.replies[parentId] {
+		if reply.Room == room {
+			replies = append(replies, *reply)
+		}
+	}
+
+	return &parentCopy, replies, true
+}
+
+// Latest returns copies of the latest messages of a room in the order they were sent.
+// If limit is not positive, all stored messages of the room are returned.
+func (history *History) Latest(room string, limit int) []chat.Message {
+	history.mutex.RLock()
+	defer history.mutex.RUnlock()
+
+	roomMessages := history.rooms[room]
+	if limit > 0 && len(roomMessages) > limit {
+		roomMessages = roomMessages[len(roomMessages)-limit:]
+	}
+
+	messages := make([]chat.Message, 0, len(roomMessages))
+	for _, message := range roomMessages {
+		messageCopy := *message
+		if message.Thread != nil {
+			summary := *message.Thread
+			messageCopy.Thread = &summary
+		}
+		messages = append(messages, messageCopy)
+	}
+	return messages
+}
+
+// Get returns a copy of a stored message
+func (history *History) Get(room string, id string) (chat.Message, bool) {
+	history.mutex.RLock()
+	defer history.mutex.RUnlock()
+
+	message, ok := history.messages[id]
+	if !ok || message.Room != room {
+		return chat.Message{}, false
+	}
+
+	messageCopy := *message
+	messageCopy.Thread = nil
+	return messageCopy, true
+}
+
+// Edit replaces the text of a stored message
+func (history *History) Edit(room string, id string, text string) {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	message, ok := history.messages[id]
+	if !ok || message.Room != room {
+		return
+	}
+
+	message.Text = text
+}
+
+// Delete removes a stored message. If it is a reply, it is removed from its thread as well
+// and the update of the thread's summary is returned.
+func (history *History) Delete(room string, id string) *chat.Message {
+	history.mutex.Lock()
+	defer history.mutex.Unlock()
+
+	message, ok := history.messages[id]
+	if !ok || message.Room != room {
+		return nil
+	}
+
+	history.rooms[room] = without(history.rooms[room], id)
+	history.evict(message)
+
+	parent, ok := history.messages[message.ParentId]
+	if !ok || parent.Thread == nil {
+		return nil
+	}
+
+	summary := *parent.Thread
+	summary.ReplyCount--
+	parent.Thread = &summary
+
+	return threadUpdate(parent)
+}
+
+// threadUpdate creates the message that informs the clients about the changed summary of a thread's parent message
+func threadUpdate(parent *chat.Message) *chat.Message {
+	summary := *parent.Thread
+	return &chat.Message{
+		Type:   chat.ThreadMessage,
+		Room:   parent.Room,
+		Target: parent.Id,
+		Thread: &summary,
+		SentAt: time.Now(),
+	}
+}
+
+// without returns the messages except the one with the supplied id
+func without(messages []*chat.Message, id string) []*chat.Message {
+	for i, message := range messages {
+		if message.Id == id {
+			return append(messages[:i:i], messages[i+1:]...)
+		}
+	}
+	return messages
+}
+
+// evict removes a message that dropped out of its room's history from the indices and from the replies of its thread
+func (history *History) evict(message *chat.Message) {
+	delete(history.messages, message.Id)
+	delete(history.replies, message.Id)
+	if message.ParentId != "" {
+		history.replies[message.ParentId] = without(history.replies[message.ParentId], message.Id)
+		if len(history.replies[message.ParentId]) == 0 {
+			delete(history.replies, message.ParentId)
+		}
+	}
+}
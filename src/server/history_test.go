@@ -0,0 +1,129 @@
+package main
+
+import (
+	"reflect"
+	"scale-chat/chat"
+	"testing"
+)
+
+// replyIds returns the ids of a thread's replies
+func replyIds(replies []chat.Message) []string {
+	ids := make([]string, 0, len(replies))
+	for _, reply := range replies {
+		ids = append(ids, reply.Id)
+	}
+	return ids
+}
+
+func TestHistoryReplies(t *testing.T) {
+	tests := []struct {
+		name     string
+		messages []chat.Message
+		// thread is the parent message that is looked up in room a
+		thread  string
+		replies []string
+		// updates are the ids of the parents of the returned thread updates, one per message
+		updates []string
+	}{
+		{
+			name: "reply",
+			messages: []chat.Message{
+				{Id: "1", Room: "a"},
+				{Id: "2", Room: "a", ParentId: "1"},
+			},
+			thread:  "1",
+			replies: []string{"2"},
+			updates: []string{"", "1"},
+		},
+		{
+			name: "nested reply",
+			messages: []chat.Message{
+				{Id: "1", Room: "a"},
+				{Id: "2", Room: "a", ParentId: "1"},
+				{Id: "3", Room: "a", ParentId: "2"},
+			},
+			thread:  "1",
+			replies: []string{"2", "3"},
+			updates: []string{"", "1", "1"},
+		},
+		{
+			name: "reply from another room",
+			messages: []chat.Message{
+				{Id: "1", Room: "a"},
+				{Id: "2", Room: "b", ParentId: "1"},
+			},
+			thread:  "1",
+			replies: []string{},
+			updates: []string{"", ""},
+		},
+		{
+			name: "nested reply from another room",
+			messages: []chat.Message{
+				{Id: "1", Room: "a"},
+				{Id: "2", Room: "a", ParentId: "1"},
+				{Id: "3", Room: "b", ParentId: "2"},
+			},
+			thread:  "1",
+			replies: []string{"2"},
+			updates: []string{"", "1", ""},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			history := NewHistory(10)
+
+			for i, message := range test.messages {
+				message := message
+				update := history.Add(&message)
+				if update == nil && test.updates[i] != "" {
+					t.Errorf("message %v did not update thread %v", message.Id, test.updates[i])
+				}
+				if update != nil && (update.Target != test.updates[i] || update.Room != "a") {
+					t.Errorf("message %v updated thread %v of room %v, want %q", message.Id, update.Target, update.Room, test.updates[i])
+				}
+			}
+
+			parent, replies, ok := history.Thread("a", test.thread)
+			if !ok {
+				t.Fatalf("thread %v not found", test.thread)
+			}
+			if ids := replyIds(replies); !reflect.DeepEqual(ids, test.replies) {
+				t.Errorf("got replies %v, want %v", ids, test.replies)
+			}
+			if count := len(test.replies); count > 0 && (parent.Thread == nil || parent.Thread.ReplyCount != count) {
+				t.Errorf("got summary %+v, want %v replies", parent.Thread, count)
+			}
+			if len(test.replies) == 0 && parent.Thread != nil {
+				t.Errorf("got summary %+v for a thread without replies", parent.Thread)
+			}
+
+			// Messages of other rooms are not part of the thread
+			if _, _, ok := history.Thread("b", test.thread); ok {
+				t.Errorf("found thread %v in room b", test.thread)
+			}
+		})
+	}
+}
+
+func TestHistoryEvictsReplies(t *testing.T) {
+	history := NewHistory(3)
+
+	history.Add(&chat.Message{Id: "root", Room: "a"})
+	history.Add(&chat.Message{Id: "1", Room: "a", ParentId: "root"})
+	history.Add(&chat.Message{Id: "2", Room: "a", ParentId: "root"})
+
+	// An evicted reply is no longer part of its thread
+	history.evict(history.messages["1"])
+	if _, replies, _ := history.Thread("a", "root"); !reflect.DeepEqual(replyIds(replies), []string{"2"}) {
+		t.Errorf("got replies %v, want [2]", replyIds(replies))
+	}
+
+	// The thread drops out with its messages
+	for _, id := range []string{"3", "4", "5"} {
+		history.Add(&chat.Message{Id: id, Room: "a"})
+	}
+	if len(history.messages) != 3 || len(history.replies) != 0 {
+		t.Errorf("got messages %v and replies %v of evicted messages", history.messages, history.replies)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"google.golang.org/grpc/metadata"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// identitySecret signs the identity tokens, users can only claim the names that hold a role if it is set
+var identitySecret []byte
+
+var (
+	errInvalidToken     = errors.New("the identity token is invalid")
+	errReservedIdentity = errors.New("the name is reserved, it requires an identity token")
+	errNoIdentitySecret = errors.New("identity tokens are disabled, IDENTITY_SECRET is not set")
+)
+
+// initIdentities reads the secret of the identity tokens from IDENTITY_SECRET
+func initIdentities() {
+	identitySecret = []byte(os.Getenv("IDENTITY_SECRET"))
+	if len(identitySecret) == 0 {
+		log.Println("IDENTITY_SECRET is not set, roles are only granted to users with an identity token")
+	}
+}
+
+// NewIdentityToken signs an identity. The token proves the identity to every server that shares the secret.
+func NewIdentityToken(identity string) (string, error) {
+	if len(identitySecret) == 0 {
+		return "", errNoIdentitySecret
+	}
+	return identity + "." + signIdentity(identity), nil
+}
+
+// VerifyIdentityToken returns the identity of a token that was signed with the secret
+func VerifyIdentityToken(token string) (string, bool) {
+	separator := strings.LastIndexByte(token, '.')
+	if len(identitySecret) == 0 || separator <= 0 {
+		return "", false
+	}
+
+	identity := token[:separator]
+	if !hmac.Equal([]byte(token[separator+1:]), []byte(signIdentity(identity))) {
+		return "", false
+	}
+	return identity, true
+}
+
+// signIdentity returns the hex encoded HMAC of an identity
+func signIdentity(identity string) string {
+	mac := hmac.New(sha256.New, identitySecret)
+	mac.Write([]byte(identity))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// claimIdentity checks whether a user may use a name. Names that hold a role in a room are reserved for the users
+// that verified them with an identity token.
+func claimIdentity(identity string, verified string) error {
+	if identity != "" && identity != verified && rooms.Reserved(identity) {
+		return errReservedIdentity
+	}
+	return nil
+}
+
+// requestIdentity returns the identity a request claims and the identity its token verified. The token is read from
+// the token query parameter, as browsers cannot set headers for websocket requests, or the Authorization header.
+// Requests with a token but without name use the token's identity.
+func requestIdentity(req *http.Request) (string, string, error) {
+	identity := req.URL.Query().Get("name")
+
+	token := req.URL.Query().Get("token")
+	if token == "" {
+		token = strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	}
+
+	verified := ""
+	if token != "" {
+		var ok bool
+		verified, ok = VerifyIdentityToken(token)
+		if !ok {
+			return "", "", errInvalidToken
+		}
+		if identity == "" {
+			identity = verified
+		}
+	}
+
+	return identity, verified, claimIdentity(identity, verified)
+}
+
+// rejectUnverified responds with 401 Unauthorized and returns true if the request claims a reserved name
+// without the identity token of the name
+func rejectUnverified(writer http.ResponseWriter, req *http.Request) bool {
+	_, _, err := requestIdentity(req)
+	if err == nil {
+		return false
+	}
+
+	http.Error(writer, err.Error(), http.StatusUnauthorized)
+	return true
+}
+
+// grpcIdentity returns the identity the token in the authorization metadata of a gRPC call verified
+func grpcIdentity(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, value := range md.Get("authorization") {
+		verified, ok := VerifyIdentityToken(strings.TrimPrefix(value, "Bearer "))
+		if !ok {
+			return "", errInvalidToken
+		}
+		return verified, nil
+	}
+	return "", nil
+}
@@ -0,0 +1,567 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"scale-chat/chat"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ircServerName is the prefix of the replies the IRC gateway sends
+const ircServerName = "scale-chat"
+
+// maxIrcEchoes is the maximum number of own messages an IRC channel remembers to suppress their echo
+const maxIrcEchoes = 1000
+
+// ircSession is a connection of an IRC client. Every channel the client joins is registered as a separate
+// client of the corresponding room, channel #room maps to the room "room".
+type ircSession struct {
+	netConn    net.Conn
+	writeMutex sync.Mutex
+	mutex      sync.Mutex
+	nick       string
+	// verified is the identity of the token the client sent with PASS
+	verified   string
+	user       string
+	registered bool
+	channels   map[string]*ircChannelConn
+}
+
+// ircChannelConn is the connection of a single channel that an IRC client joined
+type ircChannelConn struct {
+	session  *ircSession
+	channel  string
+	messages chan *chat.Message
+	// echoes are the messages sent by this channel, IRC clients do not expect them to be sent back
+	echoes    map[*chat.Message]struct{}
+	echoMutex sync.Mutex
+	client    *Client
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// ListenIRC accepts IRC client connections on the supplied address
+func ListenIRC(address string) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal("Could not listen on IRC gateway port: ", err)
+	}
+
+	log.Println("IRC gateway will be listening for incoming connections on:", address)
+
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			log.Println("Cannot accept IRC connection:", err)
+			continue
+		}
+
+		session := &ircSession{netConn: netConn, channels: make(map[string]*ircChannelConn)}
+		go session.handle()
+	}
+}
+
+// handle reads the commands of the IRC client until the connection breaks
+func (session *ircSession) handle() {
+	log.Println("Got new IRC connection")
+
+	defer func() {
+		session.partAll()
+		_ = session.netConn.Close()
+		log.Println("IRC connection is gone")
+	}()
+
+	scanner := bufio.NewScanner(session.netConn)
+	scanner.Buffer(make([]byte, 0, 512), maxLineSize)
+
+	for scanner.Scan() {
+		prefixless := strings.TrimRight(scanner.Text(), "\r")
+		if strings.HasPrefix(prefixless, ":") {
+			// Clients must not send a prefix, but if they do it is ignored
+			space := strings.IndexByte(prefixless, ' ')
+			if space < 0 {
+				continue
+			}
+			prefixless = prefixless[space+1:]
+		}
+
+		command, params := parseIrcLine(prefixless)
+		if command == "" {
+			continue
+		}
+
+		if !session.execute(command, params) {
+			return
+		}
+	}
+}
+
+// parseIrcLine splits an IRC line into its command and parameters. The trailing parameter may contain spaces.
+func parseIrcLine(line string) (string, []string) {
+	var trailing *string
+	if index := strings.Index(line, " :"); index >= 0 {
+		rest := line[index+2:]
+		trailing = &rest
+		line = line[:index]
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		return "", nil
+	}
+
+	params := fields[1:]
+	if trailing != nil {
+		params = append(params, *trailing)
+	}
+
+	return strings.ToUpper(fields[0]), params
+}
+
+// execute handles a single IRC command and returns false if the session should be closed
+func (session *ircSession) execute(command string, params []string) bool {
+	switch command {
+	case "CAP":
+		// Capability negotiation is not supported, an empty list lets clients continue the registration
+		if len(params) > 0 && strings.ToUpper(params[0]) == "LS" {
+			session.reply("CAP * LS :")
+		}
+		return true
+	case "PING":
+		token := ircServerName
+		if len(params) > 0 {
+			token = params[0]
+		}
+		session.reply("PONG " + ircServerName + " :" + token)
+		return true
+	case "QUIT":
+		return false
+	case "PASS":
+		// The password is an identity token, it lets the client use the nick of a user that holds a role
+		verified, ok := "", false
+		if len(params) > 0 {
+			verified, ok = VerifyIdentityToken(params[0])
+		}
+		if !ok {
+			session.numeric("464", ":Password incorrect")
+			return true
+		}
+		session.mutex.Lock()
+		session.verified = verified
+		session.mutex.Unlock()
+		return true
+	case "NICK":
+		if len(params) < 1 || strings.ContainsAny(params[0], " ,:#\x00") {
+			session.numeric("431", ":No nickname given")
+			return true
+		}
+		session.mutex.Lock()
+		verified := session.verified
+		session.mutex.Unlock()
+		if err := claimIdentity(params[0], verified); err != nil {
+			session.numeric("433", params[0]+" :"+err.Error())
+			return true
+		}
+		session.changeNick(params[0])
+		return true
+	case "USER":
+		if len(params) < 1 {
+			session.numeric("461", "USER :Not enough parameters")
+			return true
+		}
+		session.mutex.Lock()
+		session.user = params[0]
+		session.mutex.Unlock()
+		session.register()
+		return true
+	}
+
+	session.mutex.Lock()
+	registered := session.registered
+	session.mutex.Unlock()
+
+	if !registered {
+		session.numeric("451", ":You have not registered")
+		return true
+	}
+
+	switch command {
+	case "JOIN":
+		if len(params) < 1 {
+			session.numeric("461", "JOIN :Not enough parameters")
+			return true
+		}
+		var keys []string
+		if len(params) > 1 {
+			keys = strings.Split(params[1], ",")
+		}
+		for i, channel := range strings.Split(params[0], ",") {
+			key := ""
+			if i < len(keys) {
+				key = keys[i]
+			}
+			session.join(channel, key)
+		}
+	case "PART":
+		if len(params) < 1 {
+			session.numeric("461", "PART :Not enough parameters")
+			return true
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			session.part(channel)
+		}
+	case "PRIVMSG":
+		if len(params) < 2 {
+			session.numeric("412", ":No text to send")
+			return true
+		}
+		session.privmsg(params[0], params[1])
+	case "NAMES":
+		if len(params) < 1 {
+			session.numeric("366", "* :End of /NAMES list")
+			return true
+		}
+		for _, channel := range strings.Split(params[0], ",") {
+			session.names(channel)
+		}
+	default:
+		session.numeric("421", command+" :Unknown command")
+	}
+
+	return true
+}
+
+// changeNick sets the nick of the session and renames the clients of the joined channels
+func (session *ircSession) changeNick(nick string) {
+	session.mutex.Lock()
+	oldNick := session.nick
+	session.nick = nick
+	registered := session.registered
+	channels := session.channelList()
+	session.mutex.Unlock()
+
+	for _, channel := range channels {
+		channel.client.SetIdentity(nick)
+	}
+
+	if registered {
+		session.send(":" + ircPrefix(oldNick) + " NICK :" + nick)
+		return
+	}
+	session.register()
+}
+
+// register completes the registration as soon as NICK and USER were received
+func (session *ircSession) register() {
+	session.mutex.Lock()
+	if session.registered || session.nick == "" || session.user == "" {
+		session.mutex.Unlock()
+		return
+	}
+	session.registered = true
+	session.mutex.Unlock()
+
+	session.numeric("001", ":Welcome to scale-chat "+session.getNick())
+	session.numeric("002", ":Your host is "+ircServerName)
+	session.numeric("003", ":This server was created "+time.Now().Format(time.RFC1123))
+	session.numeric("004", ircServerName+" scale-chat o o")
+	session.numeric("422", ":MOTD File is missing")
+}
+
+// join registers a new client for the channel's room. The key is the password of password-protected rooms.
+func (session *ircSession) join(channel string, key string) {
+	room, ok := ircRoom(channel)
+	if !ok {
+		session.numeric("403", channel+" :No such channel")
+		return
+	}
+
+	session.mutex.Lock()
+	if _, joined := session.channels[channel]; joined {
+		session.mutex.Unlock()
+		return
+	}
+
+	switch rooms.Admit(room, session.nick, session.verified != "" && session.nick == session.verified, key) {
+	case errNotInvited:
+		session.mutex.Unlock()
+		session.numeric("473", channel+" :Cannot join channel (+i)")
+		return
+	case errWrongPassword:
+		session.mutex.Unlock()
+		session.numeric("475", channel+" :Cannot join channel (+k)")
+		return
+	}
+
+	if err := limiter.Acquire(hostOf(session.netConn.RemoteAddr().String()), room); err != nil {
+		session.mutex.Unlock()
+		session.numeric("471", channel+" :Cannot join channel ("+err.Error()+")")
+		return
+	}
+
+	conn := &ircChannelConn{
+		session:  session,
+		channel:  channel,
+		messages: make(chan *chat.Message),
+		echoes:   make(map[*chat.Message]struct{}),
+		closed:   make(chan struct{}),
+	}
+	nick := session.nick
+	conn.client = NewClient(conn, room, "", nick, session.verified)
+	session.channels[channel] = conn
+	session.mutex.Unlock()
+
+	go func() {
+		conn.client.Run()
+		session.leave(conn)
+	}()
+
+	session.send(":" + ircPrefix(nick) + " JOIN " + channel)
+	if topic := ircText(rooms.Get(room).Topic); topic != "" {
+		session.numeric("332", channel+" :"+topic)
+	} else {
+		session.numeric("331", channel+" :No topic is set")
+	}
+	session.names(channel)
+}
+
+// part closes the client of the channel
+func (session *ircSession) part(channel string) {
+	session.mutex.Lock()
+	conn, joined := session.channels[channel]
+	delete(session.channels, channel)
+	nick := session.nick
+	session.mutex.Unlock()
+
+	if !joined {
+		session.numeric("442", channel+" :You're not on that channel")
+		return
+	}
+
+	_ = conn.Close()
+	session.send(":" + ircPrefix(nick) + " PART " + channel)
+}
+
+// leave removes the channel after its client stopped without a PART, e.g. because it was kicked or banned,
+// so the IRC client learns about it and can join the channel again
+func (session *ircSession) leave(conn *ircChannelConn) {
+	session.mutex.Lock()
+	if session.channels[conn.channel] != conn {
+		// The channel was parted or the session ended
+		session.mutex.Unlock()
+		return
+	}
+	delete(session.channels, conn.channel)
+	nick := session.nick
+	session.mutex.Unlock()
+
+	session.reply("KICK " + conn.channel + " " + nick + " :You were removed from the channel")
+}
+
+// partAll closes the clients of all joined channels
+func (session *ircSession) partAll() {
+	session.mutex.Lock()
+	channels := session.channelList()
+	session.channels = make(map[string]*ircChannelConn)
+	session.mutex.Unlock()
+
+	for _, channel := range channels {
+		_ = channel.Close()
+	}
+}
+
+// privmsg passes a message to the client of the channel, which submits it to the broadcasting loop
+func (session *ircSession) privmsg(channel string, text string) {
+	session.mutex.Lock()
+	conn, joined := session.channels[channel]
+	nick := session.nick
+	session.mutex.Unlock()
+
+	if !joined {
+		session.numeric("404", channel+" :Cannot send to channel")
+		return
+	}
+
+	room, _ := ircRoom(channel)
+	message := &chat.Message{
+		Text:   text,
+		Sender: nick,
+		SentAt: time.Now(),
+		Room:   room,
+	}
+
+	conn.rememberEcho(message)
+
+	select {
+	case conn.messages <- message:
+	case <-conn.closed:
+	}
+}
+
+// names sends the identities of the room's clients
+func (session *ircSession) names(channel string) {
+	room, ok := ircRoom(channel)
+	if ok {
+		session.mutex.Lock()
+		_, joined := session.channels[channel]
+		nick := session.nick
+		session.mutex.Unlock()
+
+		// The client of a channel that was just joined might not be registered yet
+		nicks := make([]string, 0)
+		if joined {
+			nicks = append(nicks, nick)
+		}
+		for _, member := range RoomMembers(room) {
+			if member != nick || !joined {
+				nicks = append(nicks, ircNick(member))
+			}
+		}
+		session.numeric("353", "= "+channel+" :"+strings.Join(nicks, " "))
+	}
+	session.numeric("366", channel+" :End of /NAMES list")
+}
+
+// channelList returns the joined channels, the caller has to hold the session's mutex
+func (session *ircSession) channelList() []*ircChannelConn {
+	channels := make([]*ircChannelConn, 0, len(session.channels))
+	for _, channel := range session.channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+func (session *ircSession) getNick() string {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.nick
+}
+
+// numeric sends a numeric reply to the client
+func (session *ircSession) numeric(code string, text string) {
+	nick := session.getNick()
+	if nick == "" {
+		nick = "*"
+	}
+	session.reply(code + " " + nick + " " + text)
+}
+
+// reply sends a line prefixed with the server name to the client
+func (session *ircSession) reply(line string) {
+	session.send(":" + ircServerName + " " + line)
+}
+
+// send writes a line to the client
+func (session *ircSession) send(line string) {
+	_ = session.write(line)
+}
+
+func (session *ircSession) write(line string) error {
+	session.writeMutex.Lock()
+	defer session.writeMutex.Unlock()
+
+	_, err := session.netConn.Write([]byte(line + "\r\n"))
+	return err
+}
+
+// ReadMessage returns the next message the IRC client sent to the channel
+func (conn *ircChannelConn) ReadMessage() (*chat.Message, error) {
+	select {
+	case message := <-conn.messages:
+		return message, nil
+	case <-conn.closed:
+		return nil, errConnClosed
+	}
+}
+
+// WriteMessage sends the message as PRIVMSG to the IRC client, unless it was sent by the client itself
+func (conn *ircChannelConn) WriteMessage(message *chat.Message) error {
+	conn.echoMutex.Lock()
+	_, echo := conn.echoes[message]
+	delete(conn.echoes, message)
+	conn.echoMutex.Unlock()
+
+	if echo {
+		return nil
+	}
+
+	prefix := ircPrefix(ircNick(message.Sender))
+	for _, line := range ircLines(message.Text) {
+		err := conn.session.write(fmt.Sprintf(":%s PRIVMSG %s :%s", prefix, conn.channel, line))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (conn *ircChannelConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+	return nil
+}
+
+func (conn *ircChannelConn) Transport() string {
+	return "irc"
+}
+
+// rememberEcho marks a message as sent by this channel
+func (conn *ircChannelConn) rememberEcho(message *chat.Message) {
+	conn.echoMutex.Lock()
+	defer conn.echoMutex.Unlock()
+
+	// Echoes of skipped messages never arrive, so the set is reset instead of growing forever
+	if len(conn.echoes) >= maxIrcEchoes {
+		conn.echoes = make(map[*chat.Message]struct{})
+	}
+	conn.echoes[message] = struct{}{}
+}
+
+// ircRoom maps an IRC channel to a room
+func ircRoom(channel string) (string, bool) {
+	if !strings.HasPrefix(channel, "#") || len(channel) < 2 {
+		return "", false
+	}
+	return channel[1:], true
+}
+
+// ircNickReplacer replaces the characters that are not allowed in IRC nicks, line breaks and NUL characters would
+// let senders inject IRC commands
+var ircNickReplacer = strings.NewReplacer(" ", "_", ",", "_", ":", "_", "!", "_", "@", "_",
+	"\r", "_", "\n", "_", "\x00", "_")
+
+// ircNick converts a sender to a valid IRC nick
+func ircNick(sender string) string {
+	if sender == "" {
+		return "anonymous"
+	}
+	return ircNickReplacer.Replace(sender)
+}
+
+// ircLines splits a text into the lines of IRC messages. Every kind of line break ends a line, empty lines and
+// NUL characters are dropped, so the text cannot inject IRC commands.
+func ircLines(text string) []string {
+	return strings.FieldsFunc(strings.ReplaceAll(text, "\x00", ""), func(r rune) bool {
+		return r == '\r' || r == '\n'
+	})
+}
+
+// ircText converts a text to a single IRC line
+func ircText(text string) string {
+	return strings.Join(ircLines(text), " ")
+}
+
+// ircPrefix builds the message prefix of a nick
+func ircPrefix(nick string) string {
+	return nick + "!" + nick + "@" + ircServerName
+}
+
+func (conn *ircChannelConn) RemoteAddr() string {
+	return conn.session.netConn.RemoteAddr().String()
+}
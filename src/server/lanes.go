@@ -0,0 +1,169 @@
+package main
+
+import (
+	"log"
+	"scale-chat/chat"
+	"sync"
+)
+
+// Lane is a queue of a client's outgoing messages. Control messages are sent before chat messages.
+type Lane int
+
+const (
+	// ControlLane carries system messages, confirmations and actions like edits, deletions and kicks.
+	// Its messages are never dropped, clients that do not read them are disconnected instead.
+	ControlLane Lane = iota
+	// ChatLane carries chat messages, which are dropped if the client lags behind
+	ChatLane
+)
+
+func (lane Lane) String() string {
+	return []string{"control", "chat"}[lane]
+}
+
+// laneOf returns the lane of a message, all messages with a type are control messages
+func laneOf(message *chat.Message) Lane {
+	if message.Type == "" {
+		return ChatLane
+	}
+	return ControlLane
+}
+
+// laneSize is the maximum number of messages that are queued in each lane of a client
+var laneSize = messageBufferSize
+
+// laneQueue is a bounded queue of outgoing messages. Its buffer is only allocated while messages are queued,
+// so idle clients do not hold any buffers.
+type laneQueue struct {
+	messages []*MessageWrapper
+	mutex    sync.Mutex
+}
+
+// push appends a message unless the queue is full
+func (queue *laneQueue) push(wrapper *MessageWrapper) bool {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if len(queue.messages) >= laneSize {
+		return false
+	}
+	queue.messages = append(queue.messages, wrapper)
+	return true
+}
+
+// pop removes the oldest message, it returns nil if the queue is empty
+func (queue *laneQueue) pop() *MessageWrapper {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if len(queue.messages) == 0 {
+		return nil
+	}
+
+	wrapper := queue.messages[0]
+	queue.messages[0] = nil
+	queue.messages = queue.messages[1:]
+	// The buffer is released as soon as the queue was drained
+	if len(queue.messages) == 0 {
+		queue.messages = nil
+	}
+	return wrapper
+}
+
+// Len returns the number of queued messages
+func (queue *laneQueue) Len() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return len(queue.messages)
+}
+
+// Cap returns the capacity of the allocated buffer
+func (queue *laneQueue) Cap() int {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return cap(queue.messages)
+}
+
+// enqueue passes a message to the client's outgoing handler without blocking.
+// Chat messages are dropped if the chat lane is full, clients whose control lane is full are disconnected.
+func (client *Client) enqueue(wrapper *MessageWrapper) {
+	lane := laneOf(wrapper.message)
+
+	queue := &client.chat
+	if lane == ControlLane {
+		queue = &client.control
+	}
+
+	if queue.push(wrapper) {
+		select {
+		case client.ready <- struct{}{}:
+		default:
+			// The outgoing handler was already notified
+		}
+		client.wakeup()
+		return
+	}
+
+	LaneDropsCounterVec.WithLabelValues(lane.String()).Inc()
+
+	if lane == ControlLane {
+		log.Println("Client's control lane is full, disconnecting the client")
+		client.Kick("Your connection is too slow to receive the messages of the server")
+		return
+	}
+
+	log.Println("Client's chat lane is full, skipping the message")
+}
+
+// next blocks until a message is queued and prefers the control lane.
+// It returns nil if the client is kicked or its incoming handler finished.
+func (client *Client) next() *MessageWrapper {
+	for {
+		if wrapper := client.poll(); wrapper != nil {
+			return wrapper
+		}
+
+		select {
+		case <-client.ready:
+		case reason := <-client.kicked:
+			client.disconnect(reason)
+			return nil
+		case <-client.done:
+			return nil
+		}
+	}
+}
+
+// poll returns the next queued message without blocking and prefers the control lane.
+// It returns nil if no message is queued.
+func (client *Client) poll() *MessageWrapper {
+	if wrapper := client.control.pop(); wrapper != nil {
+		return wrapper
+	}
+	return client.chat.pop()
+}
+
+// queued returns the number of messages in both lanes
+func (client *Client) queued() int {
+	return client.control.Len() + client.chat.Len()
+}
+
+// wakeup notifies connections without outgoing handler about queued messages
+func (client *Client) wakeup() {
+	if client.wake != nil {
+		client.wake()
+	}
+}
+
+// laneDepth sums the queued messages of a lane over all clients
+func laneDepth(lane Lane) float64 {
+	depth := 0
+	for _, client := range ActiveClients() {
+		if lane == ControlLane {
+			depth += client.control.Len()
+		} else {
+			depth += client.chat.Len()
+		}
+	}
+	return float64(depth)
+}
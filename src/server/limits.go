@@ -0,0 +1,207 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultLimitRetryAfter is the default delay that is suggested to rejected clients
+const defaultLimitRetryAfter = 5 * time.Second
+
+// Reasons why the limiter refuses a connection
+var (
+	errServerFull         = errors.New("the server has reached its connection limit")
+	errTooManyConnections = errors.New("too many connections from your address")
+	errRoomFull           = errors.New("the room has reached its member limit")
+)
+
+// ConnectionLimits caps the connections of this server, a limit of 0 disables it
+type ConnectionLimits struct {
+	MaxConnections      int
+	MaxConnectionsPerIP int
+	// MaxRoomMembers limits the connections that subscribed to a single room
+	MaxRoomMembers int
+	// RetryAfter is the delay that is suggested to rejected clients
+	RetryAfter time.Duration
+}
+
+// ConnectionLimiter counts the connections of this server and refuses new ones that exceed the limits.
+// Connections are counted from the moment they are admitted until the client is removed.
+type ConnectionLimiter struct {
+	limits  ConnectionLimits
+	mutex   sync.Mutex
+	total   int
+	perIP   map[string]int
+	perRoom map[string]int
+}
+
+// limiter admits the connections of all transports, it has no limits until initLimiter is called
+var limiter = NewConnectionLimiter(ConnectionLimits{RetryAfter: defaultLimitRetryAfter})
+
+// initLimiter reads the limits from MAX_CONNECTIONS, MAX_CONNECTIONS_PER_IP, MAX_ROOM_MEMBERS and LIMIT_RETRY_AFTER
+func initLimiter() {
+	limiter = NewConnectionLimiter(ConnectionLimits{
+		MaxConnections:      getEnvInt("MAX_CONNECTIONS", 0),
+		MaxConnectionsPerIP: getEnvInt("MAX_CONNECTIONS_PER_IP", 0),
+		MaxRoomMembers:      getEnvInt("MAX_ROOM_MEMBERS", 0),
+		RetryAfter:          getEnvDuration("LIMIT_RETRY_AFTER", defaultLimitRetryAfter),
+	})
+
+	log.Printf("Connection limits: %v total, %v per IP, %v per room (0 is unlimited)",
+		limiter.limits.MaxConnections, limiter.limits.MaxConnectionsPerIP, limiter.limits.MaxRoomMembers)
+}
+
+// NewConnectionLimiter creates a limiter without connections
+func NewConnectionLimiter(limits ConnectionLimits) *ConnectionLimiter {
+	return &ConnectionLimiter{
+		limits:  limits,
+		perIP:   make(map[string]int),
+		perRoom: make(map[string]int),
+	}
+}
+
+// Acquire counts a new connection of the address to the room, unless it exceeds a limit
+func (limiter *ConnectionLimiter) Acquire(ip string, room string) error {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	var err error
+	switch {
+	case shedder.RejectsConnections():
+		err = errOverloaded
+	case exceeds(limiter.total, limiter.limits.MaxConnections):
+		err = errServerFull
+	case exceeds(limiter.perIP[ip], limiter.limits.MaxConnectionsPerIP):
+		err = errTooManyConnections
+	case exceeds(limiter.perRoom[room], limiter.limits.MaxRoomMembers):
+		err = errRoomFull
+	}
+	if err != nil {
+		LimitRejectionsCounterVec.WithLabelValues(limitReason(err)).Inc()
+		return err
+	}
+
+	limiter.total++
+	limiter.perIP[ip]++
+	limiter.perRoom[room]++
+	return nil
+}
+
+// Release stops counting a connection and the rooms it subscribed to
+func (limiter *ConnectionLimiter) Release(ip string, rooms []string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	limiter.total--
+	decrement(limiter.perIP, ip)
+	for _, room := range rooms {
+		decrement(limiter.perRoom, room)
+	}
+}
+
+// AcquireRoom counts an admitted connection as member of another room, unless the room is full
+func (limiter *ConnectionLimiter) AcquireRoom(room string) error {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	if exceeds(limiter.perRoom[room], limiter.limits.MaxRoomMembers) {
+		LimitRejectionsCounterVec.WithLabelValues(limitReason(errRoomFull)).Inc()
+		return errRoomFull
+	}
+
+	limiter.perRoom[room]++
+	return nil
+}
+
+// ReleaseRoom stops counting a connection as member of a room
+func (limiter *ConnectionLimiter) ReleaseRoom(room string) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	decrement(limiter.perRoom, room)
+}
+
+// Headroom returns the number of connections that can still be admitted in total, from the busiest address
+// and to the fullest room. Limits that are disabled are reported as -1.
+func (limiter *ConnectionLimiter) Headroom() (total int, perIP int, perRoom int) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	return headroom(limiter.total, limiter.limits.MaxConnections),
+		headroom(maxCount(limiter.perIP), limiter.limits.MaxConnectionsPerIP),
+		headroom(maxCount(limiter.perRoom), limiter.limits.MaxRoomMembers)
+}
+
+// rejectOverLimit admits the connection of the request to the room or responds with 503 Service Unavailable,
+// respectively 429 Too Many Requests for clients that exceed their address' limit. Admitted connections
+// are released when their client is removed, handlers that fail before starting the client have to release them.
+// The per-IP limit is keyed on the address of the connection, X-Forwarded-For is only honoured for trusted proxies.
+func rejectOverLimit(writer http.ResponseWriter, req *http.Request, room string) bool {
+	err := limiter.Acquire(hostOf(remoteAddress(req)), room)
+	if err == nil {
+		return false
+	}
+
+	log.Println("Rejecting connection:", err)
+
+	status := http.StatusServiceUnavailable
+	if err == errTooManyConnections {
+		status = http.StatusTooManyRequests
+	}
+
+	writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(limiter.limits.RetryAfter.Seconds()))))
+	http.Error(writer, err.Error(), status)
+	return true
+}
+
+// limitReason returns the label of the rejections metric
+func limitReason(err error) string {
+	switch err {
+	case errOverloaded:
+		return "overload"
+	case errServerFull:
+		return "connections"
+	case errTooManyConnections:
+		return "connections_per_ip"
+	default:
+		return "room_members"
+	}
+}
+
+// exceeds indicates whether another connection would exceed the limit, 0 is unlimited
+func exceeds(count int, limit int) bool {
+	return limit > 0 && count >= limit
+}
+
+// headroom returns the remaining connections or -1 if the limit is disabled
+func headroom(count int, limit int) int {
+	if limit <= 0 {
+		return -1
+	}
+	return limit - count
+}
+
+// decrement lowers a counter and forgets it when it reaches 0
+func decrement(counts map[string]int, key string) {
+	if counts[key] <= 1 {
+		delete(counts, key)
+		return
+	}
+	counts[key]--
+}
+
+// maxCount returns the highest counter
+func maxCount(counts map[string]int) int {
+	highest := 0
+	for _, count := range counts {
+		if count > highest {
+			highest = count
+		}
+	}
+	return highest
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"scale-chat/chat"
+	"sync"
+	"time"
+)
+
+// defaultPollTimeout is the maximum duration a poll request waits for new messages
+const defaultPollTimeout = 25 * time.Second
+
+// defaultPollSessionTimeout is the duration after which a session without poll requests is closed
+const defaultPollSessionTimeout = 60 * time.Second
+
+var pollTimeout = defaultPollTimeout
+
+var pollSessionTimeout = defaultPollSessionTimeout
+
+// pollSessions maps the session ids to the connections of the long-polling clients
+var pollSessions = make(map[string]*longPollConn)
+
+var pollSessionsMutex sync.Mutex
+
+// PollResponse is the response body of the poll endpoint
+type PollResponse struct {
+	Session  string          `json:"session"`
+	Messages []*chat.Message `json:"messages"`
+}
+
+// longPollConn buffers the messages of a long-polling client until they are fetched by the next poll request.
+// Clients send their messages via the send endpoint.
+type longPollConn struct {
+	session    string
+	remoteAddr string
+	mutex      sync.Mutex
+	pending    []*chat.Message
+	lastPoll   time.Time
+	notify     chan struct{}
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// initLongPolling reads the long-polling configuration
+func initLongPolling() {
+	pollTimeout = getEnvDuration("POLL_TIMEOUT", defaultPollTimeout)
+	pollSessionTimeout = getEnvDuration("POLL_SESSION_TIMEOUT", defaultPollSessionTimeout)
+}
+
+// ReadMessage blocks until the session expires or the connection is closed,
+// because long-polling clients send their messages via the send endpoint
+func (conn *longPollConn) ReadMessage() (*chat.Message, error) {
+	ticker := time.NewTicker(pollSessionTimeout / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-conn.closed:
+			return nil, errConnClosed
+		case <-ticker.C:
+			conn.mutex.Lock()
+			idle := time.Since(conn.lastPoll)
+			conn.mutex.Unlock()
+
+			if idle > pollSessionTimeout {
+				log.Println("Long-polling session expired")
+				_ = conn.Close()
+			}
+		}
+	}
+}
+
+// WriteMessage buffers the message until the next poll request. If the buffer is full, the message is skipped.
+func (conn *longPollConn) WriteMessage(message *chat.Message) error {
+	select {
+	case <-conn.closed:
+		return errConnClosed
+	default:
+	}
+
+	conn.mutex.Lock()
+	if len(conn.pending) >= messageBufferSize {
+		conn.mutex.Unlock()
+		log.Println("Long-polling buffer is full, skipping the message")
+		return nil
+	}
+	conn.pending = append(conn.pending, message)
+	conn.mutex.Unlock()
+
+	select {
+	case conn.notify <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Close closes the connection and removes its session
+func (conn *longPollConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+
+		pollSessionsMutex.Lock()
+		delete(pollSessions, conn.session)
+		pollSessionsMutex.Unlock()
+	})
+	return nil
+}
+
+func (conn *longPollConn) Session() string {
+	return conn.session
+}
+
+func (conn *longPollConn) Transport() string {
+	return "long-polling"
+}
+
+func (conn *longPollConn) RemoteAddr() string {
+	return conn.remoteAddr
+}
+
+// Poll waits until there are pending messages, the timeout elapsed or the request got cancelled
+// and returns the pending messages
+func (conn *longPollConn) Poll(ctx context.Context, timeout time.Duration) []*chat.Message {
+	conn.touch()
+	defer conn.touch()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		conn.mutex.Lock()
+		if len(conn.pending) > 0 {
+			messages := conn.pending
+			conn.pending = nil
+			conn.mutex.Unlock()
+			return messages
+		}
+		conn.mutex.Unlock()
+
+		select {
+		case <-conn.notify:
+		case <-timer.C:
+			return []*chat.Message{}
+		case <-ctx.Done():
+			return []*chat.Message{}
+		case <-conn.closed:
+			return []*chat.Message{}
+		}
+	}
+}
+
+// touch marks the session as active
+func (conn *longPollConn) touch() {
+	conn.mutex.Lock()
+	conn.lastPoll = time.Now()
+	conn.mutex.Unlock()
+}
+
+// Handles the /poll endpoint. Requests without a session start a new long-polling session,
+// requests with a session wait for the session's next messages.
+func pollHandler(writer http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	room := vars["room"]
+	query := req.URL.Query()
+
+	session := query.Get("session")
+	if session == "" {
+		log.Println("Got new long-polling connection")
+
+		if rejectUnverified(writer, req) || rejectBanned(writer, req, room) || rejectInaccessible(writer, req, room) || rejectOverLimit(writer, req, room) {
+			return
+		}
+
+		conn := &longPollConn{
+			session:    uuid.New().String(),
+			remoteAddr: remoteAddress(req),
+			lastPoll:   time.Now(),
+			notify:     make(chan struct{}, 1),
+			closed:     make(chan struct{}),
+		}
+
+		pollSessionsMutex.Lock()
+		pollSessions[conn.session] = conn
+		pollSessionsMutex.Unlock()
+
+		identity, verified, _ := requestIdentity(req)
+		go StartClient(conn, room, query.Get("thread"), identity, verified)
+
+		writeJSON(writer, http.StatusOK, PollResponse{Session: conn.session, Messages: []*chat.Message{}})
+		return
+	}
+
+	pollSessionsMutex.Lock()
+	conn, ok := pollSessions[session]
+	pollSessionsMutex.Unlock()
+
+	if !ok {
+		http.Error(writer, "session not found", http.StatusNotFound)
+		return
+	}
+
+	messages := conn.Poll(req.Context(), pollTimeout)
+
+	writeJSON(writer, http.StatusOK, PollResponse{Session: session, Messages: messages})
+}
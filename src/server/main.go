@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/websocket"
@@ -18,6 +19,7 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  128,
 	WriteBufferSize: 128,
+	Subprotocols:    chat.Subprotocols(),
 }
 
 func main() {
@@ -42,45 +44,105 @@ func main() {
 		log.Println("Distributor will be disabled.")
 	}
 
-	var distributeIncoming chan *chat.Message
 	var distributeOutgoing chan *chat.Message
+	var distributeModeration chan *ModerationEvent
+	var distributeRooms chan *RoomSettings
 	if enableDist {
 		serverId := uuid.New().String()
 		log.Println("ServerId for distribution: ", serverId)
 
-		distributeIncoming = make(chan *chat.Message)
-		distributeOutgoing = make(chan *chat.Message)
-		distr := Distributor{
-			Server:         os.Getenv("DIST_SERVER"),
-			ServerPassword: os.Getenv("DIST_SERVER_PASSWORD"),
-			Topic:          os.Getenv("DIST_TOPIC"),
-			Incoming:       distributeIncoming,
-			Outgoing:       distributeOutgoing,
+		backend := os.Getenv("DIST_BACKEND")
+		if backend == "" {
+			backend = "redis"
+		}
+
+		distr, err := NewDistributor(backend)
+		if err != nil {
+			log.Panicln("Couldn't create the distributor:", err)
 		}
 
-		err = distr.Ping()
+		ctx := context.Background()
+		err = distr.Connect(ctx)
 		if err != nil {
 			log.Panicln("Couldn't connect to the distributor. Pinging failed", err)
 		}
+		log.Println("Messages are distributed via the backend:", backend)
 
-		go distr.Subscribe(serverId)
-		go distr.Publish(serverId)
+		distributeOutgoing = make(chan *chat.Message)
+		distributeModeration = make(chan *ModerationEvent)
+		distributeRooms = make(chan *RoomSettings)
+		distribution := Distribution{
+			Distributor: distr,
+			ServerId:    serverId,
+			Outgoing:    distributeOutgoing,
+			Moderation:  distributeModeration,
+			Rooms:       distributeRooms,
+		}
+
+		go func() {
+			if err := distribution.Subscribe(ctx); err != nil {
+				log.Fatal("Failed to subscribe to the distributor: ", err)
+			}
+		}()
+		go func() {
+			if err := distribution.Publish(ctx); err != nil {
+				log.Fatal("Failed to publish distMsg via the distributor: ", err)
+			}
+		}()
 	}
 
+	initTrustedProxies()
+	initIdentities()
+	initPipeline()
+	initWebhooks()
+	initModeration(distributeModeration)
+	initRooms(distributeRooms)
+	initCommands()
+	initSubscriptions()
+	initLimiter()
+	initRateLimits()
+	initShedding()
+	initBots(incoming)
+
+	history = NewHistory(getEnvInt("HISTORY_SIZE", defaultHistorySize))
+
+	initCompression()
+	initBuffers()
+	initBatching()
+	initNetpoll()
+	initLongPolling()
+
 	go BroadcastMessages(enableDist, distributeOutgoing)
 
-	// Register separate ServeMux instances for public endpoints and internal metrics
+	// Register separate routers for public endpoints and internal metrics and administration
 	publicMux := mux.NewRouter()
-	internalMux := http.NewServeMux()
+	internalMux := mux.NewRouter()
 
 	// Register public endpoints
 	publicMux.HandleFunc("/", demoHandler)
 	publicMux.HandleFunc("/ws", wsHandler)
 	publicMux.HandleFunc("/ws/{room}", wsHandler)
+	publicMux.HandleFunc("/sse", sseHandler).Methods(http.MethodGet)
+	publicMux.HandleFunc("/sse/{room}", sseHandler).Methods(http.MethodGet)
+	publicMux.HandleFunc("/poll", pollHandler).Methods(http.MethodGet)
+	publicMux.HandleFunc("/poll/{room}", pollHandler).Methods(http.MethodGet)
+	publicMux.HandleFunc("/send", sendHandler).Methods(http.MethodPost)
+	publicMux.HandleFunc("/send/{room}", sendHandler).Methods(http.MethodPost)
+	publicMux.HandleFunc("/api/rooms/{room}", roomHandler).Methods(http.MethodGet)
+	publicMux.HandleFunc("/api/rooms/{room}/messages", publishHandler).Methods(http.MethodPost)
+	publicMux.HandleFunc("/api/rooms/{room}/threads/{id}", threadHandler).Methods(http.MethodGet)
 
 	// Register Prometheus endpoint
 	internalMux.Handle("/metrics", promhttp.Handler())
 
+	// Register admin endpoints if an admin token is configured
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	if adminToken != "" {
+		RegisterAdminHandlers(internalMux, adminToken)
+	} else {
+		log.Println("ADMIN_TOKEN is not set, the admin API is disabled")
+	}
+
 	// Initiate Prometheus monitoring
 	InitMonitoring()
 
@@ -98,6 +160,24 @@ func main() {
 		}
 	}()
 
+	// Listen on the TCP gateway port if it is configured
+	tcpAddress := os.Getenv("TCP_GATEWAY_ADDRESS")
+	if tcpAddress != "" {
+		go ListenTCP(tcpAddress)
+	}
+
+	// Listen on the IRC gateway port if it is configured
+	ircAddress := os.Getenv("IRC_GATEWAY_ADDRESS")
+	if ircAddress != "" {
+		go ListenIRC(ircAddress)
+	}
+
+	// Listen on the gRPC port if it is configured
+	grpcAddress := os.Getenv("GRPC_ADDRESS")
+	if grpcAddress != "" {
+		go ListenGRPC(grpcAddress)
+	}
+
 	// Listen on public endpoint port
 	l, err := net.Listen("tcp", ":8080")
 	if err != nil {
@@ -106,7 +186,7 @@ func main() {
 
 	log.Println("Chat server will be listening for incoming requests on port: 8080")
 
-	if err := http.Serve(l, publicMux); err != nil {
+	if err := http.Serve(countingListener{Listener: l}, publicMux); err != nil {
 		log.Fatal("Serving the chat server failed:", err)
 	}
 }
@@ -118,14 +198,37 @@ func wsHandler(writer http.ResponseWriter, req *http.Request) {
 
 	vars := mux.Vars(req)
 	room := vars["room"]
+	thread := req.URL.Query().Get("thread")
+
+	if rejectUnverified(writer, req) || rejectBanned(writer, req, room) || rejectInaccessible(writer, req, room) || rejectOverLimit(writer, req, room) {
+		return
+	}
+
+	identity, verified, _ := requestIdentity(req)
+
+	if netpoll != nil {
+		netpoll.Serve(writer, req, room, thread, identity, verified)
+		return
+	}
+
+	compression := upgrader.EnableCompression && offersCompression(req)
 
 	wsConn, err := upgrader.Upgrade(writer, req, nil)
 	if err != nil {
 		log.Print("Cannot upgrade to websocket connection:", err)
+		limiter.Release(hostOf(remoteAddress(req)), []string{room})
 		return
 	}
 
-	StartClient(wsConn, room)
+	if compression {
+		err = wsConn.SetCompressionLevel(compressionLevel)
+		if err != nil {
+			log.Println("Cannot set compression level:", err)
+		}
+	}
+
+	// The handler returns right away, so the HTTP server releases the buffers of the hijacked connection
+	go StartClient(newWebsocketConn(wsConn, compression, acceptsBatches(req), remoteAddress(req)), room, thread, identity, verified)
 }
 
 // Handles the / endpoint and serves the demo html chat client
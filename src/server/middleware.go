@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"scale-chat/chat"
+	"strings"
+	"time"
+)
+
+// MessageContext describes the user that sent a message
+type MessageContext struct {
+	// Identity of the user, it might differ from the sender of the message
+	Identity string
+	// Authenticated is set if the user verified the identity with a token
+	Authenticated bool
+	IP            string
+	// Session identifies the connection or API token the message was sent with, it is empty if there is none
+	Session string
+}
+
+// Middleware processes the messages that clients send before they are broadcast.
+// It can inspect and modify the message or reject it by returning an error, which is reported to the sender.
+type Middleware interface {
+	// Name identifies the middleware in the configuration and the metrics
+	Name() string
+	Process(ctx *MessageContext, message *chat.Message) error
+}
+
+// Pipeline runs middlewares in order and stops at the first one that rejects the message
+type Pipeline []Middleware
+
+// pipeline processes all messages that are submitted by clients
+var pipeline = Pipeline{}
+
+// middlewareFactories creates the built-in middlewares by their name
+var middlewareFactories = map[string]func() (Middleware, error){
+	"timestamp":  func() (Middleware, error) { return TimestampMiddleware{}, nil },
+	"wordfilter": newWordFilterFromEnv,
+	"linkstrip":  func() (Middleware, error) { return LinkStripMiddleware{}, nil },
+	"spam":       newSpamMiddlewareFromEnv,
+}
+
+// RegisterMiddleware makes a middleware available to the MIDDLEWARES configuration
+func RegisterMiddleware(name string, factory func() (Middleware, error)) {
+	middlewareFactories[name] = factory
+}
+
+// initPipeline builds the pipeline from the comma-separated middleware names in MIDDLEWARES,
+// e.g. "wordfilter,linkstrip,timestamp". Messages are not processed if it is not set.
+func initPipeline() {
+	names := os.Getenv("MIDDLEWARES")
+
+	var err error
+	pipeline, err = NewPipeline(names)
+	if err != nil {
+		log.Fatal("Cannot create the middleware pipeline: ", err)
+	}
+
+	log.Println("Message middlewares:", names)
+}
+
+// NewPipeline creates the middlewares with the supplied comma-separated names in that order
+func NewPipeline(names string) (Pipeline, error) {
+	pipeline := Pipeline{}
+	if strings.TrimSpace(names) == "" {
+		return pipeline, nil
+	}
+
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		factory, ok := middlewareFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown middleware: %v", name)
+		}
+
+		middleware, err := factory()
+		if err != nil {
+			return nil, fmt.Errorf("cannot create middleware %v: %w", name, err)
+		}
+		pipeline = append(pipeline, middleware)
+	}
+
+	return pipeline, nil
+}
+
+// Process runs the message through all middlewares and returns the error of the middleware that rejected it
+func (pipeline Pipeline) Process(ctx *MessageContext, message *chat.Message) error {
+	for _, middleware := range pipeline {
+		start := time.Now()
+		err := middleware.Process(ctx, message)
+		MiddlewareLatencyVec.WithLabelValues(middleware.Name()).Observe(time.Since(start).Seconds())
+
+		if err != nil {
+			MiddlewareRejectionsCounterVec.WithLabelValues(middleware.Name()).Inc()
+			return err
+		}
+	}
+	return nil
+}
+
+// TimestampMiddleware adds the time the server received the message
+type TimestampMiddleware struct{}
+
+func (TimestampMiddleware) Name() string {
+	return "timestamp"
+}
+
+func (TimestampMiddleware) Process(_ *MessageContext, message *chat.Message) error {
+	now := time.Now()
+	message.ReceivedAt = &now
+	return nil
+}
+
+// WordFilterMiddleware masks blocked words, or rejects the message if Reject is set
+type WordFilterMiddleware struct {
+	pattern *regexp.Regexp
+	Reject  bool
+}
+
+// NewWordFilter creates a filter for the supplied words, which are matched case-insensitively as whole words
+func NewWordFilter(words []string, reject bool) (*WordFilterMiddleware, error) {
+	quoted := make([]string, 0, len(words))
+	for _, word := range words {
+		word = strings.TrimSpace(word)
+		if word != "" {
+			quoted = append(quoted, regexp.QuoteMeta(word))
+		}
+	}
+
+	if len(quoted) == 0 {
+		return nil, errors.New("no words to filter")
+	}
+
+	pattern, err := regexp.Compile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	if err != nil {
+		return nil, err
+	}
+
+	return &WordFilterMiddleware{pattern: pattern, Reject: reject}, nil
+}
+
+// newWordFilterFromEnv creates a filter for the comma-separated words in WORD_FILTER.
+// If WORD_FILTER_REJECT is set, messages with blocked words are rejected instead of masked.
+func newWordFilterFromEnv() (Middleware, error) {
+	return NewWordFilter(strings.Split(os.Getenv("WORD_FILTER"), ","), getEnvBool("WORD_FILTER_REJECT", false))
+}
+
+func (filter *WordFilterMiddleware) Name() string {
+	return "wordfilter"
+}
+
+func (filter *WordFilterMiddleware) Process(_ *MessageContext, message *chat.Message) error {
+	if !filter.pattern.MatchString(message.Text) {
+		return nil
+	}
+
+	if filter.Reject {
+		return errors.New("the message contains blocked words")
+	}
+
+	message.Text = filter.pattern.ReplaceAllStringFunc(message.Text, func(word string) string {
+		return strings.Repeat("*", len([]rune(word)))
+	})
+	return nil
+}
+
+// linkPattern matches http(s) urls and www. hostnames
+var linkPattern = regexp.MustCompile(`(?i)\b(https?://|www\.)\S+`)
+
+// LinkStripMiddleware replaces links with a placeholder
+type LinkStripMiddleware struct{}
+
+func (LinkStripMiddleware) Name() string {
+	return "linkstrip"
+}
+
+func (LinkStripMiddleware) Process(_ *MessageContext, message *chat.Message) error {
+	message.Text = linkPattern.ReplaceAllString(message.Text, "[link removed]")
+	return nil
+}
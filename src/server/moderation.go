@@ -0,0 +1,304 @@
+package main
+
+import (
+	"github.com/google/uuid"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Kinds of sanctions
+const (
+	// BanSanction prevents a user from connecting
+	BanSanction = "ban"
+	// MuteSanction allows a user to read, but not to send messages
+	MuteSanction = "mute"
+)
+
+// defaultModerationFile is the file the sanctions are persisted to if MODERATION_FILE is not set
+const defaultModerationFile = "moderation.json"
+
+// Sanction bans or mutes the users that match its identity or IP address.
+// A sanction without room applies to all rooms, a sanction without expiry date is permanent.
+type Sanction struct {
+	Id        string     `json:"id"`
+	Kind      string     `json:"kind"`
+	Identity  string     `json:"identity,omitempty"`
+	IP        string     `json:"ip,omitempty"`
+	Room      string     `json:"room,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// ModerationEvent is exchanged via the distributor to keep the sanctions of all servers in sync.
+// It either carries a new sanction or the id of a revoked one.
+type ModerationEvent struct {
+	Sanction *Sanction `json:"sanction,omitempty"`
+	Revoked  string    `json:"revoked,omitempty"`
+}
+
+// Moderation holds the active sanctions and persists them to a file
+type Moderation struct {
+	mutex     sync.RWMutex
+	sanctions map[string]Sanction
+	path      string
+	// distribute receives the events that have to be sent to the other servers, it is nil if distribution is disabled
+	distribute chan<- *ModerationEvent
+}
+
+// moderation holds the sanctions of this server
+var moderation = NewModeration("", nil)
+
+// NewModeration creates an empty sanction registry. If a path is supplied, the sanctions are persisted to that file.
+func NewModeration(path string, distribute chan<- *ModerationEvent) *Moderation {
+	return &Moderation{
+		sanctions:  make(map[string]Sanction),
+		path:       path,
+		distribute: distribute,
+	}
+}
+
+// initModeration loads the persisted sanctions. Changes are sent to the supplied channel if it is not nil.
+func initModeration(distribute chan<- *ModerationEvent) {
+	path := os.Getenv("MODERATION_FILE")
+	if path == "" {
+		path = defaultModerationFile
+	}
+
+	moderation = NewModeration(path, distribute)
+
+	err := moderation.Load()
+	if err != nil {
+		log.Printf("Cannot load sanctions from %v: %v", path, err)
+	}
+}
+
+// Expired indicates whether the sanction is no longer in effect
+func (sanction *Sanction) Expired(now time.Time) bool {
+	return sanction.ExpiresAt != nil && !now.Before(*sanction.ExpiresAt)
+}
+
+// Matches indicates whether the sanction applies to a user with the supplied identity and IP address in the room
+func (sanction *Sanction) Matches(identity string, ip string, room string) bool {
+	if sanction.Room != "" && sanction.Room != room {
+		return false
+	}
+
+	return (sanction.Identity != "" && sanction.Identity == identity) ||
+		(sanction.IP != "" && sanction.IP == ip)
+}
+
+// Load reads the sanctions from the file. A missing file is not an error.
+func (moderation *Moderation) Load() error {
+	if moderation.path == "" {
+		return nil
+	}
+
+	var sanctions []Sanction
+	found, err := loadJSONFile(moderation.path, &sanctions)
+	if !found || err != nil {
+		return err
+	}
+
+	moderation.mutex.Lock()
+	defer moderation.mutex.Unlock()
+
+	now := time.Now()
+	for _, sanction := range sanctions {
+		if !sanction.Expired(now) {
+			moderation.sanctions[sanction.Id] = sanction
+		}
+	}
+
+	log.Printf("Loaded %v sanctions from %v", len(moderation.sanctions), moderation.path)
+
+	return nil
+}
+
+// Add imposes a new sanction, enforces it on the connected clients and sends it to the other servers.
+// Missing ids and creation dates are filled in.
+func (moderation *Moderation) Add(sanction Sanction) Sanction {
+	if sanction.Id == "" {
+		sanction.Id = uuid.New().String()
+	}
+	if sanction.CreatedAt.IsZero() {
+		sanction.CreatedAt = time.Now()
+	}
+
+	moderation.Apply(&ModerationEvent{Sanction: &sanction})
+	moderation.publish(&ModerationEvent{Sanction: &sanction})
+
+	return sanction
+}
+
+// Revoke lifts a sanction and returns false if it does not exist
+func (moderation *Moderation) Revoke(id string) bool {
+	moderation.mutex.RLock()
+	_, ok := moderation.sanctions[id]
+	moderation.mutex.RUnlock()
+
+	if !ok {
+		return false
+	}
+
+	moderation.Apply(&ModerationEvent{Revoked: id})
+	moderation.publish(&ModerationEvent{Revoked: id})
+
+	return true
+}
+
+// Apply changes the sanctions according to an event without sending it to the other servers.
+// New bans disconnect the matching clients, new mutes notify them.
+func (moderation *Moderation) Apply(event *ModerationEvent) {
+	moderation.mutex.Lock()
+	if event.Sanction != nil {
+		moderation.sanctions[event.Sanction.Id] = *event.Sanction
+	}
+	if event.Revoked != "" {
+		delete(moderation.sanctions, event.Revoked)
+	}
+	moderation.save()
+	moderation.mutex.Unlock()
+
+	if event.Sanction != nil {
+		enforce(event.Sanction)
+	}
+}
+
+// List returns the sanctions that are in effect ordered by their creation date
+func (moderation *Moderation) List() []Sanction {
+	moderation.mutex.RLock()
+	defer moderation.mutex.RUnlock()
+
+	now := time.Now()
+	sanctions := make([]Sanction, 0, len(moderation.sanctions))
+	for _, sanction := range moderation.sanctions {
+		if !sanction.Expired(now) {
+			sanctions = append(sanctions, sanction)
+		}
+	}
+
+	sort.Slice(sanctions, func(i, j int) bool {
+		return sanctions[i].CreatedAt.Before(sanctions[j].CreatedAt)
+	})
+
+	return sanctions
+}
+
+// Find returns a sanction of the supplied kind that applies to the user in the room, or nil if there is none
+func (moderation *Moderation) Find(kind string, identity string, ip string, room string) *Sanction {
+	moderation.mutex.RLock()
+	defer moderation.mutex.RUnlock()
+
+	now := time.Now()
+	for _, sanction := range moderation.sanctions {
+		if sanction.Kind == kind && !sanction.Expired(now) && sanction.Matches(identity, ip, room) {
+			return &sanction
+		}
+	}
+
+	return nil
+}
+
+// publish sends an event to the other servers if distribution is enabled
+func (moderation *Moderation) publish(event *ModerationEvent) {
+	if moderation.distribute != nil {
+		moderation.distribute <- event
+	}
+}
+
+// save writes the sanctions that are in effect to the file, the caller has to hold the lock
+func (moderation *Moderation) save() {
+	if moderation.path == "" {
+		return
+	}
+
+	now := time.Now()
+	sanctions := make([]Sanction, 0, len(moderation.sanctions))
+	for id, sanction := range moderation.sanctions {
+		if sanction.Expired(now) {
+			delete(moderation.sanctions, id)
+			continue
+		}
+		sanctions = append(sanctions, sanction)
+	}
+
+	err := saveJSONFile(moderation.path, sanctions)
+	if err != nil {
+		log.Printf("Cannot persist sanctions to %v: %v", moderation.path, err)
+	}
+}
+
+// enforce removes the clients that are banned by the sanction from the affected rooms and notifies the ones that are muted
+func enforce(sanction *Sanction) {
+	for _, client := range ActiveClients() {
+		// Sanctions without room apply to all rooms the client subscribed to
+		if sanction.Room != "" && !client.Subscribed(sanction.Room) {
+			continue
+		}
+		if !sanction.Matches(client.Identity(), client.IP(), sanction.Room) {
+			continue
+		}
+
+		switch {
+		case sanction.Kind == MuteSanction:
+			client.Notify(sanctionNotice(sanction))
+		case sanction.Room == "":
+			client.Kick(sanctionNotice(sanction))
+		default:
+			client.Remove(sanction.Room, sanctionNotice(sanction))
+		}
+	}
+}
+
+// sanctionNotice describes the sanction to the affected user
+func sanctionNotice(sanction *Sanction) string {
+	notice := "You are banned"
+	if sanction.Kind == MuteSanction {
+		notice = "You are muted"
+	}
+
+	if sanction.Room != "" {
+		notice += " in room " + sanction.Room
+	}
+	if sanction.ExpiresAt != nil {
+		notice += " until " + sanction.ExpiresAt.Format(time.RFC3339)
+	}
+	if sanction.Reason != "" {
+		notice += ": " + sanction.Reason
+	}
+
+	return notice
+}
+
+// rejectBanned responds with 403 Forbidden and returns true if the user that sent the request is banned from the room.
+// It is called before a connection is upgraded.
+func rejectBanned(writer http.ResponseWriter, req *http.Request, room string) bool {
+	identity, _, _ := requestIdentity(req)
+	ban := moderation.Find(BanSanction, identity, hostOf(remoteAddress(req)), room)
+	if ban == nil {
+		return false
+	}
+
+	log.Println("Rejecting banned user:", sanctionNotice(ban))
+	http.Error(writer, sanctionNotice(ban), http.StatusForbidden)
+	return true
+}
+
+// hostOf strips the port from an address and normalizes IP addresses, other addresses without port are returned unchanged
+func hostOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	// Different notations of an address, e.g. IPv4-mapped IPv6 addresses, share their bans and limits
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String()
+	}
+	return host
+}
@@ -12,6 +12,36 @@ var MessageCounterVec = prometheus.NewCounterVec(
 	[]string{"type"},
 )
 
+var MessageBytesCounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "messages",
+		Name:      "bytes_total",
+		Help:      "Total number of encoded message bytes read from and written to clients",
+	},
+	[]string{"direction", "encoding"},
+)
+
+var CompressionBytesCounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "compression",
+		Name:      "bytes_total",
+		Help:      "Total number of bytes of compressed outgoing messages before (raw) and after compression (compressed)",
+	},
+	[]string{"kind"},
+)
+
+var ConnectionsGaugeVec = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "scale_chat",
+		Subsystem: "connections",
+		Name:      "active",
+		Help:      "Number of connected clients per transport",
+	},
+	[]string{"transport"},
+)
+
 var MessageProcessingTime = prometheus.NewHistogram(
 	prometheus.HistogramOpts{
 		Namespace: "scale_chat",
@@ -21,7 +51,307 @@ var MessageProcessingTime = prometheus.NewHistogram(
 	},
 )
 
+var MiddlewareLatencyVec = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "scale_chat",
+		Subsystem: "middleware",
+		Name:      "duration_seconds",
+		Help:      "Time a middleware takes to process a message",
+	},
+	[]string{"middleware"},
+)
+
+var MiddlewareRejectionsCounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "middleware",
+		Name:      "rejections_total",
+		Help:      "Total number of messages a middleware rejected",
+	},
+	[]string{"middleware"},
+)
+
+var SpamFlagsCounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "spam",
+		Name:      "flagged_total",
+		Help:      "Total number of messages flagged as spam per reason",
+	},
+	[]string{"reason"},
+)
+
+var WebhookDeliveriesCounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "webhooks",
+		Name:      "deliveries_total",
+		Help:      "Total number of webhook deliveries per result: success, retry, failure or dropped",
+	},
+	[]string{"result"},
+)
+
+var WebhookDurationSeconds = prometheus.NewHistogram(
+	prometheus.HistogramOpts{
+		Namespace: "scale_chat",
+		Subsystem: "webhooks",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of the requests to webhooks",
+	},
+)
+
+var WebhookQueueGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "scale_chat",
+		Subsystem: "webhooks",
+		Name:      "queue_length",
+		Help:      "Number of webhook deliveries waiting in the queue",
+	},
+)
+
+var CommandCounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "commands",
+		Name:      "executed_total",
+		Help:      "Total number of slash commands clients ran per command",
+	},
+	[]string{"command"},
+)
+
+var BotRepliesCounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "bots",
+		Name:      "replies_total",
+		Help:      "Total number of messages bots sent into rooms per bot",
+	},
+	[]string{"bot"},
+)
+
+var SubscriptionCounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "subscriptions",
+		Name:      "changes_total",
+		Help:      "Total number of rooms clients subscribed to or unsubscribed from per type",
+	},
+	[]string{"type"},
+)
+
+var LimitRejectionsCounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "limits",
+		Name:      "rejections_total",
+		Help:      "Total number of connections that were rejected per exceeded limit",
+	},
+	[]string{"limit"},
+)
+
+var ConnectionsHeadroomGauge = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Namespace: "scale_chat",
+		Subsystem: "limits",
+		Name:      "connections_headroom",
+		Help:      "Number of connections the server still admits, -1 if it is unlimited",
+	},
+	func() float64 {
+		total, _, _ := limiter.Headroom()
+		return float64(total)
+	},
+)
+
+var IPHeadroomGauge = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Namespace: "scale_chat",
+		Subsystem: "limits",
+		Name:      "connections_per_ip_headroom",
+		Help:      "Number of connections the busiest address may still open, -1 if it is unlimited",
+	},
+	func() float64 {
+		_, perIP, _ := limiter.Headroom()
+		return float64(perIP)
+	},
+)
+
+var RoomHeadroomGauge = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Namespace: "scale_chat",
+		Subsystem: "limits",
+		Name:      "room_members_headroom",
+		Help:      "Number of members the fullest room still admits, -1 if it is unlimited",
+	},
+	func() float64 {
+		_, _, perRoom := limiter.Headroom()
+		return float64(perRoom)
+	},
+)
+
+var SheddingLevelGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "scale_chat",
+		Subsystem: "shedding",
+		Name:      "level",
+		Help:      "Current load shedding level: 0 none, 1 throttling clients and dropping low-priority messages, 2 rejecting connections",
+	},
+)
+
+var SheddingLoadGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "scale_chat",
+		Subsystem: "shedding",
+		Name:      "load_ratio",
+		Help:      "Highest ratio of a load signal to its threshold",
+	},
+)
+
+var SheddingSignalGaugeVec = prometheus.NewGaugeVec(
+	prometheus.GaugeOpts{
+		Namespace: "scale_chat",
+		Subsystem: "shedding",
+		Name:      "signal",
+		Help:      "Last sampled value of the load signals: queue_depth, goroutines, processing_seconds and gc_pause_seconds",
+	},
+	[]string{"signal"},
+)
+
+var SheddingDropsCounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "shedding",
+		Name:      "dropped_total",
+		Help:      "Total number of low-priority messages dropped while shedding load per kind",
+	},
+	[]string{"kind"},
+)
+
+var RateLimitedCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "limits",
+		Name:      "rate_limited_total",
+		Help:      "Total number of client messages dropped by the rate limits",
+	},
+)
+
+var LaneDropsCounterVec = prometheus.NewCounterVec(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "lanes",
+		Name:      "dropped_total",
+		Help:      "Total number of outgoing messages that did not fit into a client's lane, clients with a full control lane are disconnected",
+	},
+	[]string{"lane"},
+)
+
+var ControlLaneDepthGauge = newLaneDepthGauge(ControlLane)
+
+var ChatLaneDepthGauge = newLaneDepthGauge(ChatLane)
+
+// newLaneDepthGauge creates a gauge that sums the queued messages of a lane when it is scraped
+func newLaneDepthGauge(lane Lane) prometheus.GaugeFunc {
+	return prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Namespace:   "scale_chat",
+			Subsystem:   "lanes",
+			Name:        "queue_depth",
+			Help:        "Number of outgoing messages waiting in the lanes of all clients",
+			ConstLabels: prometheus.Labels{"lane": lane.String()},
+		},
+		func() float64 {
+			return laneDepth(lane)
+		},
+	)
+}
+
+var NetpollOverflowCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "netpoll",
+		Name:      "overflow_total",
+		Help:      "Total number of netpoll tasks that ran in their own goroutine, because all workers were busy",
+	},
+)
+
+var WriteBatchSizeVec = prometheus.NewHistogramVec(
+	prometheus.HistogramOpts{
+		Namespace: "scale_chat",
+		Subsystem: "outgoing",
+		Name:      "batch_size",
+		Help:      "Number of messages that were written to a connection at once",
+		Buckets:   prometheus.ExponentialBuckets(1, 2, 8),
+	},
+	[]string{"transport"},
+)
+
+var ConnectionMemoryGauge = prometheus.NewGaugeFunc(
+	prometheus.GaugeOpts{
+		Namespace: "scale_chat",
+		Name:      "connection_memory_bytes",
+		Help:      "Estimated mean memory per connection in bytes, including its buffers, lanes and subscriptions",
+	},
+	meanConnectionMemory,
+)
+
+var DistributorLagGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "scale_chat",
+		Subsystem: "distributor",
+		Name:      "lag_seconds",
+		Help:      "Age difference between the newest entry of the distribution streams and the last entry this server read",
+	},
+)
+
+var DistributorPendingGauge = prometheus.NewGauge(
+	prometheus.GaugeOpts{
+		Namespace: "scale_chat",
+		Subsystem: "distributor",
+		Name:      "pending_messages",
+		Help:      "Number of entries of the distribution streams this server read but did not acknowledge yet",
+	},
+)
+
+var DistributorAckErrorsCounter = prometheus.NewCounter(
+	prometheus.CounterOpts{
+		Namespace: "scale_chat",
+		Subsystem: "distributor",
+		Name:      "ack_errors_total",
+		Help:      "Number of entries of the distribution streams that were passed on but could not be acknowledged",
+	},
+)
+
 func InitMonitoring() {
 	prometheus.MustRegister(MessageCounterVec)
+	prometheus.MustRegister(MessageBytesCounterVec)
+	prometheus.MustRegister(CompressionBytesCounterVec)
+	prometheus.MustRegister(ConnectionsGaugeVec)
 	prometheus.MustRegister(MessageProcessingTime)
+	prometheus.MustRegister(MiddlewareLatencyVec)
+	prometheus.MustRegister(MiddlewareRejectionsCounterVec)
+	prometheus.MustRegister(SpamFlagsCounterVec)
+	prometheus.MustRegister(WebhookDeliveriesCounterVec)
+	prometheus.MustRegister(WebhookDurationSeconds)
+	prometheus.MustRegister(WebhookQueueGauge)
+	prometheus.MustRegister(CommandCounterVec)
+	prometheus.MustRegister(BotRepliesCounterVec)
+	prometheus.MustRegister(SubscriptionCounterVec)
+	prometheus.MustRegister(LimitRejectionsCounterVec)
+	prometheus.MustRegister(ConnectionsHeadroomGauge)
+	prometheus.MustRegister(IPHeadroomGauge)
+	prometheus.MustRegister(RoomHeadroomGauge)
+	prometheus.MustRegister(SheddingLevelGauge)
+	prometheus.MustRegister(SheddingLoadGauge)
+	prometheus.MustRegister(SheddingSignalGaugeVec)
+	prometheus.MustRegister(SheddingDropsCounterVec)
+	prometheus.MustRegister(RateLimitedCounter)
+	prometheus.MustRegister(LaneDropsCounterVec)
+	prometheus.MustRegister(ControlLaneDepthGauge)
+	prometheus.MustRegister(ChatLaneDepthGauge)
+	prometheus.MustRegister(NetpollOverflowCounter)
+	prometheus.MustRegister(WriteBatchSizeVec)
+	prometheus.MustRegister(ConnectionMemoryGauge)
+	prometheus.MustRegister(DistributorLagGauge)
+	prometheus.MustRegister(DistributorPendingGauge)
+	prometheus.MustRegister(DistributorAckErrorsCounter)
 }
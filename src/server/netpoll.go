@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"runtime"
+	"scale-chat/chat"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Websocket engines, see initNetpoll
+const (
+	// GoroutineEngine serves every websocket connection with an incoming and an outgoing handler
+	GoroutineEngine = "goroutines"
+	// NetpollEngine watches idle websocket connections with epoll and only uses a worker while a connection
+	// is read or written
+	NetpollEngine = "netpoll"
+)
+
+// readyHandler is called by the poller once a connection is readable or hung up
+type readyHandler func(hangup bool)
+
+// netpoll serves the websocket connections if the netpoll engine is enabled, otherwise it is nil
+var netpoll *netpollEngine
+
+// netpollEngine dispatches the events of the poller to a pool of workers
+type netpollEngine struct {
+	poller *poller
+	tasks  chan func()
+	// timeout limits reading a frame after the connection became readable and writing a message
+	timeout time.Duration
+}
+
+// initNetpoll enables the netpoll engine if WS_ENGINE is set to netpoll. The server falls back to the
+// goroutine engine if the platform does not support it.
+func initNetpoll() {
+	engine := os.Getenv("WS_ENGINE")
+	if engine != NetpollEngine {
+		if engine != "" && engine != GoroutineEngine {
+			log.Printf("Unknown websocket engine %v, using %v", engine, GoroutineEngine)
+		}
+		return
+	}
+
+	p, err := newPoller()
+	if err != nil {
+		log.Printf("Cannot start the netpoll engine, using %v: %v", GoroutineEngine, err)
+		return
+	}
+
+	netpoll = &netpollEngine{
+		poller:  p,
+		tasks:   make(chan func(), getEnvInt("NETPOLL_QUEUE_SIZE", 1024)),
+		timeout: getEnvDuration("NETPOLL_TIMEOUT", 5*time.Second),
+	}
+	workers := getEnvInt("NETPOLL_WORKERS", 4*runtime.NumCPU())
+	for i := 0; i < workers; i++ {
+		go netpoll.work()
+	}
+
+	log.Printf("Websocket connections are served by the netpoll engine with %v workers", workers)
+}
+
+// work runs the queued tasks
+func (engine *netpollEngine) work() {
+	for task := range engine.tasks {
+		task()
+	}
+}
+
+// schedule queues a task for the workers. If all workers are busy and the queue is full,
+// the task runs in its own goroutine, so the poller never blocks.
+func (engine *netpollEngine) schedule(task func()) {
+	select {
+	case engine.tasks <- task:
+	default:
+		NetpollOverflowCounter.Inc()
+		go task()
+	}
+}
+
+// Serve upgrades the request to a websocket connection and starts a client without dedicated goroutines.
+// Compression is not supported by this engine.
+func (engine *netpollEngine) Serve(writer http.ResponseWriter, req *http.Request, room string, thread string, identity string, verified string) {
+	upgrader := ws.HTTPUpgrader{
+		Timeout: engine.timeout,
+		Protocol: func(protocol string) bool {
+			_, ok := chat.CodecBySubprotocol(protocol)
+			return ok
+		},
+	}
+
+	conn, buffered, handshake, err := upgrader.Upgrade(req, writer)
+	if err != nil {
+		log.Print("Cannot upgrade to websocket connection:", err)
+		limiter.Release(hostOf(remoteAddress(req)), []string{room})
+		return
+	}
+
+	codec, ok := chat.CodecBySubprotocol(handshake.Protocol)
+	if !ok {
+		codec = chat.Codecs[0]
+	}
+
+	opCode := ws.OpText
+	if codec.Binary() {
+		opCode = ws.OpBinary
+	}
+
+	npConn := &netpollConn{
+		engine:     engine,
+		conn:       conn,
+		codec:      codec,
+		opCode:     opCode,
+		arrays:     acceptsBatches(req) && isJSON(codec),
+		remoteAddr: remoteAddress(req),
+	}
+	npConn.reader = wsutil.NewServerSideReader(npConn)
+	npConn.reader.OnIntermediate = wsutil.ControlFrameHandler(lockedWriter{npConn}, ws.StateServerSide)
+
+	// The client might have sent frames right after the handshake, which were already read into the buffer
+	// of the hijacked connection and are not reported by the poller
+	if buffered != nil && buffered.Reader.Buffered() > 0 {
+		data, _ := buffered.Reader.Peek(buffered.Reader.Buffered())
+		npConn.pending = bytes.NewReader(append([]byte(nil), data...))
+	}
+
+	client := NewClient(npConn, room, thread, identity, verified)
+	client.wake = npConn.flush
+	npConn.client = client
+
+	client.register()
+	log.Println("Started a client")
+
+	client.enforceBans()
+
+	// Frames that arrived with the handshake are read before the connection is watched, as the poller does not report them
+	for npConn.pending != nil && npConn.pending.Len() > 0 {
+		if !npConn.read() {
+			npConn.closeAndUnregister()
+			return
+		}
+	}
+	npConn.pending = nil
+
+	// The client might have been kicked already, its file descriptor must not be watched then
+	npConn.closeMutex.Lock()
+	if !npConn.closed {
+		npConn.fd, err = engine.poller.Add(conn, npConn.handle)
+		npConn.watched = err == nil
+	}
+	npConn.closeMutex.Unlock()
+
+	if err != nil {
+		log.Println("Cannot watch websocket connection:", err)
+		npConn.closeAndUnregister()
+	}
+}
+
+// netpollConn exchanges messages via a websocket connection that is watched by the poller
+type netpollConn struct {
+	engine *netpollEngine
+	conn   net.Conn
+	fd     int
+	client *Client
+	// codec that was negotiated via the websocket subprotocol
+	codec  chat.Codec
+	opCode ws.OpCode
+	// arrays indicates whether batches are sent as a single JSON array frame, which clients opt in to
+	arrays bool
+	reader *wsutil.Reader
+	// pending holds bytes that were received with the handshake
+	pending    *bytes.Reader
+	writeMutex sync.Mutex
+	// flushing is 1 while a worker writes the queued messages
+	flushing int32
+	// watched and closed are guarded by closeMutex, so the poller never watches a file descriptor
+	// that was reused by another connection
+	watched    bool
+	closed     bool
+	closeMutex sync.Mutex
+	remoteAddr string
+}
+
+// Read reads the pending bytes of the handshake before reading from the connection
+func (conn *netpollConn) Read(data []byte) (int, error) {
+	if conn.pending != nil {
+		return conn.pending.Read(data)
+	}
+	return conn.conn.Read(data)
+}
+
+// handle reads a frame once the connection became readable and re-arms the connection afterwards
+func (conn *netpollConn) handle(hangup bool) {
+	conn.engine.schedule(func() {
+		if hangup {
+			conn.closeAndUnregister()
+			return
+		}
+
+		if !conn.read() {
+			conn.closeAndUnregister()
+			return
+		}
+
+		conn.resume()
+	})
+}
+
+// read reads a frame and passes its message to the client. It returns false if the connection broke.
+func (conn *netpollConn) read() bool {
+	message, err := conn.readFrame()
+	if err != nil {
+		log.Printf("Cannot read message on %v connection: %v", conn.Transport(), err)
+		return false
+	}
+
+	if message != nil {
+		conn.client.handleMessage(message, incoming)
+	}
+	return true
+}
+
+// resume re-arms the connection in the poller unless it was closed
+func (conn *netpollConn) resume() {
+	conn.closeMutex.Lock()
+	if conn.closed || !conn.watched {
+		conn.closeMutex.Unlock()
+		return
+	}
+	err := conn.engine.poller.Resume(conn.fd)
+	conn.closeMutex.Unlock()
+
+	if err != nil {
+		log.Println("Cannot watch websocket connection:", err)
+		conn.closeAndUnregister()
+	}
+}
+
+// readFrame reads the next frame. It returns no message for control frames and messages that cannot be decoded.
+func (conn *netpollConn) readFrame() (*chat.Message, error) {
+	_ = conn.conn.SetReadDeadline(time.Now().Add(conn.engine.timeout))
+	defer conn.conn.SetReadDeadline(time.Time{})
+
+	header, err := conn.reader.NextFrame()
+	if err != nil {
+		return nil, err
+	}
+
+	if header.OpCode.IsControl() {
+		return nil, conn.reader.OnIntermediate(header, conn.reader)
+	}
+
+	data, err := io.ReadAll(conn.reader)
+	if err != nil {
+		return nil, err
+	}
+
+	MessageBytesCounterVec.WithLabelValues("incoming", conn.codec.Name()).Add(float64(len(data)))
+
+	var message chat.Message
+	if conn.codec.Unmarshal(data, &message) != nil {
+		return nil, nil
+	}
+	return &message, nil
+}
+
+// flush lets a worker write the queued messages unless another worker is already writing them
+func (conn *netpollConn) flush() {
+	if !atomic.CompareAndSwapInt32(&conn.flushing, 0, 1) {
+		return
+	}
+
+	conn.engine.schedule(func() {
+		for {
+			select {
+			case reason := <-conn.client.kicked:
+				conn.client.disconnect(reason)
+				return
+			default:
+			}
+
+			batch := conn.client.fillBatch(nil)
+			if len(batch) > 0 {
+				if err := conn.client.deliver(batch); err != nil {
+					log.Printf("Cannot send message via %v: %v", conn.Transport(), err)
+					conn.closeAndUnregister()
+					return
+				}
+				continue
+			}
+
+			atomic.StoreInt32(&conn.flushing, 0)
+
+			// Messages that were queued after the lanes were found empty would not be flushed otherwise
+			if conn.client.queued()+len(conn.client.kicked) == 0 ||
+				!atomic.CompareAndSwapInt32(&conn.flushing, 0, 1) {
+				return
+			}
+		}
+	})
+}
+
+// ReadMessage is not supported, the poller reads the messages of the connection
+func (conn *netpollConn) ReadMessage() (*chat.Message, error) {
+	return nil, io.EOF
+}
+
+// WriteMessage encodes the message with the negotiated codec and writes it as a single frame.
+// Messages that cannot be encoded are skipped.
+func (conn *netpollConn) WriteMessage(message *chat.Message) error {
+	data, err := conn.codec.Marshal(message)
+	if err != nil {
+		return nil
+	}
+
+	return conn.writeFrames([][]byte{data})
+}
+
+// WriteMessages writes a batch as a single JSON array frame if the client opted in,
+// otherwise the frames of the batch are written at once
+func (conn *netpollConn) WriteMessages(messages []*chat.Message) error {
+	if conn.arrays {
+		data, err := chat.MarshalBatch(messages)
+		if err != nil {
+			return nil
+		}
+		return conn.writeFrames([][]byte{data})
+	}
+
+	payloads := make([][]byte, 0, len(messages))
+	for _, message := range messages {
+		data, err := conn.codec.Marshal(message)
+		if err != nil {
+			continue
+		}
+		payloads = append(payloads, data)
+	}
+	return conn.writeFrames(payloads)
+}
+
+// writeFrames encodes every payload as a frame and writes all frames with a single write
+func (conn *netpollConn) writeFrames(payloads [][]byte) error {
+	buffer := frameBufferPool.Get().(*bytes.Buffer)
+	defer func() {
+		buffer.Reset()
+		frameBufferPool.Put(buffer)
+	}()
+
+	size := 0
+	for _, data := range payloads {
+		_ = ws.WriteFrame(buffer, ws.NewFrame(conn.opCode, true, data))
+		size += len(data)
+	}
+
+	conn.writeMutex.Lock()
+	defer conn.writeMutex.Unlock()
+
+	_ = conn.conn.SetWriteDeadline(time.Now().Add(conn.engine.timeout))
+	_, err := conn.conn.Write(buffer.Bytes())
+	if err != nil {
+		return err
+	}
+
+	MessageBytesCounterVec.WithLabelValues("outgoing", conn.codec.Name()).Add(float64(size))
+
+	return nil
+}
+
+// Close stops watching the connection, closes it and removes the client
+func (conn *netpollConn) Close() error {
+	conn.closeAndUnregister()
+	return nil
+}
+
+// closeAndUnregister closes the connection once and removes the client from the list of active clients
+func (conn *netpollConn) closeAndUnregister() {
+	conn.closeMutex.Lock()
+	if conn.closed {
+		conn.closeMutex.Unlock()
+		return
+	}
+	conn.closed = true
+
+	log.Println("Trying to close websocket connection")
+	if conn.watched {
+		conn.engine.poller.Remove(conn.fd)
+	}
+	_ = conn.conn.Close()
+	conn.closeMutex.Unlock()
+
+	conn.client.unregister()
+	log.Println("Client is gone")
+}
+
+func (conn *netpollConn) Transport() string {
+	return "websocket"
+}
+
+func (conn *netpollConn) RemoteAddr() string {
+	return conn.remoteAddr
+}
+
+// lockedWriter writes the replies to control frames, which might interleave with the messages of a flush otherwise
+type lockedWriter struct {
+	conn *netpollConn
+}
+
+func (writer lockedWriter) Write(data []byte) (int, error) {
+	writer.conn.writeMutex.Lock()
+	defer writer.conn.writeMutex.Unlock()
+	return writer.conn.conn.Write(data)
+}
@@ -0,0 +1,120 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+)
+
+// epollEvents are the events a connection is watched for. EPOLLONESHOT disarms the connection after an event,
+// so a connection is never handled by two workers at once. It is re-armed with Resume.
+const epollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+// poller watches connections with epoll and calls their handlers once they are readable
+type poller struct {
+	fd       int
+	handlers map[int]readyHandler
+	mutex    sync.RWMutex
+}
+
+// newPoller creates an epoll instance and starts waiting for its events
+func newPoller() (*poller, error) {
+	fd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &poller{fd: fd, handlers: make(map[int]readyHandler)}
+	go p.wait()
+	return p, nil
+}
+
+// Add starts watching a connection and returns its file descriptor
+func (p *poller) Add(conn net.Conn, handler readyHandler) (int, error) {
+	fd, err := fileDescriptor(conn)
+	if err != nil {
+		return 0, err
+	}
+
+	p.mutex.Lock()
+	p.handlers[fd] = handler
+	p.mutex.Unlock()
+
+	err = syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{Events: epollEvents, Fd: int32(fd)})
+	if err != nil {
+		p.mutex.Lock()
+		delete(p.handlers, fd)
+		p.mutex.Unlock()
+		return 0, err
+	}
+	return fd, nil
+}
+
+// Resume re-arms a connection after its handler was called
+func (p *poller) Resume(fd int) error {
+	return syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_MOD, fd, &syscall.EpollEvent{Events: epollEvents, Fd: int32(fd)})
+}
+
+// Remove stops watching a connection, it has to be called before the connection is closed
+func (p *poller) Remove(fd int) {
+	p.mutex.Lock()
+	delete(p.handlers, fd)
+	p.mutex.Unlock()
+
+	_ = syscall.EpollCtl(p.fd, syscall.EPOLL_CTL_DEL, fd, nil)
+}
+
+// wait blocks on the epoll instance and dispatches the events to the handlers of the connections
+func (p *poller) wait() {
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(p.fd, events, -1)
+		if err != nil {
+			if errors.Is(err, syscall.EINTR) {
+				continue
+			}
+			log.Println("Waiting for epoll events failed:", err)
+			return
+		}
+
+		for _, event := range events[:n] {
+			p.mutex.RLock()
+			handler, ok := p.handlers[int(event.Fd)]
+			p.mutex.RUnlock()
+			if !ok {
+				continue
+			}
+
+			hangup := event.Events&(syscall.EPOLLHUP|syscall.EPOLLERR) != 0 ||
+				event.Events&syscall.EPOLLIN == 0 && event.Events&syscall.EPOLLRDHUP != 0
+			handler(hangup)
+		}
+	}
+}
+
+// fileDescriptor returns the file descriptor of the TCP connection below the supplied connection
+func fileDescriptor(conn net.Conn) (int, error) {
+	if counting, ok := conn.(*countingConn); ok {
+		conn = counting.Conn
+	}
+
+	syscallConn, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, errors.New("the connection does not expose a file descriptor")
+	}
+
+	raw, err := syscallConn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var fd int
+	err = raw.Control(func(descriptor uintptr) {
+		fd = int(descriptor)
+	})
+	return fd, err
+}
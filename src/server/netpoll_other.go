@@ -0,0 +1,25 @@
+//go:build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// poller is only implemented on Linux, the server falls back to the goroutine engine elsewhere
+type poller struct{}
+
+func newPoller() (*poller, error) {
+	return nil, errors.New("the netpoll engine requires Linux")
+}
+
+func (p *poller) Add(conn net.Conn, handler readyHandler) (int, error) {
+	return 0, errors.New("the netpoll engine requires Linux")
+}
+
+func (p *poller) Resume(fd int) error {
+	return nil
+}
+
+func (p *poller) Remove(fd int) {}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+	"os"
+	"scale-chat/chat"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Role of a user in a room
+type Role string
+
+const (
+	RoleReadOnly  Role = "read-only"
+	RoleMember    Role = "member"
+	RoleModerator Role = "moderator"
+	RoleOwner     Role = "owner"
+)
+
+// Permission is an action that is restricted to certain roles
+type Permission int
+
+const (
+	// PermPost allows sending messages and editing or deleting the own messages
+	PermPost Permission = iota
+	// PermModerateMessages allows editing and deleting the messages of others
+	PermModerateMessages
+	// PermKick allows disconnecting users with a lower role from the room
+	PermKick
+	// PermChangeSettings allows changing the room's settings like the topic
+	PermChangeSettings
+)
+
+// roleRanks orders the roles, a role has all permissions of the roles with a lower rank
+var roleRanks = map[Role]int{
+	RoleReadOnly:  0,
+	RoleMember:    1,
+	RoleModerator: 2,
+	RoleOwner:     3,
+}
+
+// requiredRanks is the minimum rank that is required for each permission
+var requiredRanks = map[Permission]int{
+	PermPost:             roleRanks[RoleMember],
+	PermModerateMessages: roleRanks[RoleModerator],
+	PermKick:             roleRanks[RoleModerator],
+	PermChangeSettings:   roleRanks[RoleOwner],
+}
+
+// Access decides who may join a room
+type Access string
+
+const (
+	AccessPublic Access = "public"
+	// AccessInvite restricts a room to the invited users and the users with an assigned role
+	AccessInvite Access = "invite"
+	// AccessPassword restricts a room to the users that know its password
+	AccessPassword Access = "password"
+)
+
+var (
+	errNotInvited    = errors.New("the room is invite-only")
+	errWrongPassword = errors.New("the room requires a valid password")
+)
+
+// defaultRoomsFile is the file the room settings are persisted to if ROOMS_FILE is not set
+const defaultRoomsFile = "rooms.json"
+
+// Valid indicates whether the role is known
+func (role Role) Valid() bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// Valid indicates whether the access policy is known
+func (access Access) Valid() bool {
+	return access == AccessPublic || access == AccessInvite || access == AccessPassword
+}
+
+// Can indicates whether the role grants the permission
+func (role Role) Can(permission Permission) bool {
+	return roleRanks[role] >= requiredRanks[permission]
+}
+
+// RoomSettings holds the topic and the access policy of a room and the roles of its users
+type RoomSettings struct {
+	Name   string `json:"name"`
+	Topic  string `json:"topic,omitempty"`
+	Access Access `json:"access"`
+	// Invited lists the identities that may join an invite-only room
+	Invited []string `json:"invited,omitempty"`
+	// InviteHashes maps the invited identities to the hash of their invite token
+	InviteHashes map[string]string `json:"invite_hashes,omitempty"`
+	// PasswordHash is the salted SHA-256 hash of the password of a password-protected room
+	PasswordHash string `json:"password_hash,omitempty"`
+	PasswordSalt string `json:"password_salt,omitempty"`
+	// DefaultRole is the role of users that have no role assigned
+	DefaultRole Role `json:"default_role"`
+	// Roles maps identities to their role
+	Roles map[string]Role `json:"roles"`
+	// Webhooks receive the events of the room
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+	// PublishTokens allow posting into the room via the messages endpoint
+	PublishTokens []PublishToken `json:"publish_tokens,omitempty"`
+	UpdatedAt     time.Time      `json:"updated_at"`
+}
+
+// PublishToken authenticates services that post into a room via HTTP. Only the hash of the token is stored.
+type PublishToken struct {
+	Id        string    `json:"id"`
+	Name      string    `json:"name"`
+	Hash      string    `json:"hash,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Role returns the role of a user in the room
+func (settings *RoomSettings) Role(identity string) Role {
+	if role, ok := settings.Roles[identity]; ok {
+		return role
+	}
+	return settings.DefaultRole
+}
+
+// Admit checks whether a user may join the room. Users of invite-only rooms either verified their identity
+// with an identity token or supply the invite token as password.
+func (settings *RoomSettings) Admit(identity string, verified bool, password string) error {
+	switch settings.Access {
+	case AccessInvite:
+		if identity == "" {
+			return errNotInvited
+		}
+		if _, ok := settings.Roles[identity]; ok && verified {
+			return nil
+		}
+		for _, invited := range settings.Invited {
+			if invited != identity {
+				continue
+			}
+			hash, ok := settings.InviteHashes[identity]
+			if verified || ok && subtle.ConstantTimeCompare([]byte(hashPassword(password, "")), []byte(hash)) == 1 {
+				return nil
+			}
+		}
+		return errNotInvited
+	case AccessPassword:
+		if settings.PasswordHash == "" ||
+			subtle.ConstantTimeCompare([]byte(hashPassword(password, settings.PasswordSalt)), []byte(settings.PasswordHash)) != 1 {
+			return errWrongPassword
+		}
+	}
+	return nil
+}
+
+// SetPassword stores the salted hash of a new password
+func (settings *RoomSettings) SetPassword(password string) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		log.Panicln("Cannot generate password salt:", err)
+	}
+
+	settings.PasswordSalt = hex.EncodeToString(salt)
+	settings.PasswordHash = hashPassword(password, settings.PasswordSalt)
+}
+
+// Redacted returns a copy of the settings without the password hash and the webhook secrets
+func (settings *RoomSettings) Redacted() RoomSettings {
+	redacted := settings.copy()
+	redacted.PasswordHash = ""
+	redacted.PasswordSalt = ""
+	redacted.InviteHashes = nil
+	for i := range redacted.Webhooks {
+		redacted.Webhooks[i].Secret = ""
+	}
+	for i := range redacted.PublishTokens {
+		redacted.PublishTokens[i].Hash = ""
+	}
+	return redacted
+}
+
+// NewPublishToken creates a token for the room and returns it together with the secret token value
+func NewPublishToken(name string) (PublishToken, string) {
+	token := randomToken()
+
+	return PublishToken{
+		Id:        uuid.New().String(),
+		Name:      name,
+		Hash:      hashPassword(token, ""),
+		CreatedAt: time.Now(),
+	}, token
+}
+
+// Invite allows a user to join the invite-only room and returns the user's invite token
+func (settings *RoomSettings) Invite(identity string) string {
+	token := randomToken()
+
+	invited := false
+	for _, existing := range settings.Invited {
+		invited = invited || existing == identity
+	}
+	if !invited {
+		settings.Invited = append(settings.Invited, identity)
+	}
+
+	if settings.InviteHashes == nil {
+		settings.InviteHashes = make(map[string]string)
+	}
+	settings.InviteHashes[identity] = hashPassword(token, "")
+
+	return token
+}
+
+// randomToken returns a hex encoded random token
+func randomToken() string {
+	random := make([]byte, 32)
+	_, err := rand.Read(random)
+	if err != nil {
+		log.Panicln("Cannot generate token:", err)
+	}
+	return hex.EncodeToString(random)
+}
+
+// PublishToken returns the publish token of the room that matches the supplied token value
+func (settings *RoomSettings) PublishToken(token string) (PublishToken, bool) {
+	hash := []byte(hashPassword(token, ""))
+	for _, publishToken := range settings.PublishTokens {
+		if subtle.ConstantTimeCompare(hash, []byte(publishToken.Hash)) == 1 {
+			return publishToken, true
+		}
+	}
+	return PublishToken{}, false
+}
+
+// hashPassword returns the hex encoded SHA-256 hash of the salted password
+func hashPassword(password string, salt string) string {
+	hash := sha256.Sum256([]byte(salt + password))
+	return hex.EncodeToString(hash[:])
+}
+
+// copy returns a deep copy of the settings
+func (settings *RoomSettings) copy() RoomSettings {
+	settingsCopy := *settings
+	settingsCopy.Invited = append([]string(nil), settings.Invited...)
+	settingsCopy.Webhooks = append([]Webhook(nil), settings.Webhooks...)
+	settingsCopy.PublishTokens = append([]PublishToken(nil), settings.PublishTokens...)
+	if settings.InviteHashes != nil {
+		settingsCopy.InviteHashes = make(map[string]string, len(settings.InviteHashes))
+		for identity, hash := range settings.InviteHashes {
+			settingsCopy.InviteHashes[identity] = hash
+		}
+	}
+	settingsCopy.Roles = make(map[string]Role, len(settings.Roles))
+	for identity, role := range settings.Roles {
+		settingsCopy.Roles[identity] = role
+	}
+	return settingsCopy
+}
+
+// RoomRegistry holds the settings of all rooms that differ from the defaults and persists them to a file
+type RoomRegistry struct {
+	mutex sync.RWMutex
+	rooms map[string]*RoomSettings
+	path  string
+	// distribute receives the changed settings that have to be sent to the other servers,
+	// it is nil if distribution is disabled
+	distribute chan<- *RoomSettings
+}
+
+// rooms holds the room settings of this server
+var rooms = NewRoomRegistry("", nil)
+
+// topicQueueSize is the number of topic changes that wait to be stored before the broadcasting loop blocks
+const topicQueueSize = 100
+
+// topicChange is a topic a client set in a room
+type topicChange struct {
+	room  string
+	topic string
+}
+
+// topicChanges are stored by a single worker, so they are applied in the order the broadcasting loop handled them
+var topicChanges = make(chan topicChange, topicQueueSize)
+
+// storeTopics updates the room settings with the topic changes one after the other
+func storeTopics(changes <-chan topicChange) {
+	for change := range changes {
+		rooms.Update(change.room, func(settings *RoomSettings) {
+			settings.Topic = change.topic
+		})
+	}
+}
+
+// NewRoomRegistry creates an empty registry. If a path is supplied, the settings are persisted to that file.
+func NewRoomRegistry(path string, distribute chan<- *RoomSettings) *RoomRegistry {
+	return &RoomRegistry{
+		rooms:      make(map[string]*RoomSettings),
+		path:       path,
+		distribute: distribute,
+	}
+}
+
+// initRooms loads the persisted room settings. Changes are sent to the supplied channel if it is not nil.
+func initRooms(distribute chan<- *RoomSettings) {
+	path := os.Getenv("ROOMS_FILE")
+	if path == "" {
+		path = defaultRoomsFile
+	}
+
+	rooms = NewRoomRegistry(path, distribute)
+
+	err := rooms.Load()
+	if err != nil {
+		log.Printf("Cannot load room settings from %v: %v", path, err)
+	}
+
+	go storeTopics(topicChanges)
+}
+
+// Load reads the room settings from the file. A missing file is not an error.
+func (registry *RoomRegistry) Load() error {
+	if registry.path == "" {
+		return nil
+	}
+
+	var settings []RoomSettings
+	found, err := loadJSONFile(registry.path, &settings)
+	if !found || err != nil {
+		return err
+	}
+
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	for i := range settings {
+		registry.rooms[settings[i].Name] = &settings[i]
+	}
+
+	log.Printf("Loaded the settings of %v rooms from %v", len(registry.rooms), registry.path)
+
+	return nil
+}
+
+// Get returns a copy of a room's settings. Rooms without settings have the default settings.
+func (registry *RoomRegistry) Get(name string) RoomSettings {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	return registry.get(name)
+}
+
+// get returns a copy of a room's settings, the caller has to hold the lock
+func (registry *RoomRegistry) get(name string) RoomSettings {
+	settings, ok := registry.rooms[name]
+	if !ok {
+		return RoomSettings{Name: name, Access: AccessPublic, DefaultRole: RoleMember, Roles: map[string]Role{}}
+	}
+	return settings.copy()
+}
+
+// List returns copies of the settings of all rooms that have settings ordered by name
+func (registry *RoomRegistry) List() []RoomSettings {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	list := make([]RoomSettings, 0, len(registry.rooms))
+	for _, settings := range registry.rooms {
+		list = append(list, settings.copy())
+	}
+
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Name < list[j].Name
+	})
+
+	return list
+}
+
+// Admit checks whether a user may join a room. The identity is verified if the user proved it with an identity token.
+func (registry *RoomRegistry) Admit(room string, identity string, verified bool, password string) error {
+	settings := registry.Get(room)
+	return settings.Admit(identity, verified, password)
+}
+
+// Webhooks returns the webhooks of a room and the global webhooks that receive the event
+func (registry *RoomRegistry) Webhooks(room string, event string) []Webhook {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	var webhooks []Webhook
+	for _, name := range []string{room, chat.AllRooms} {
+		settings, ok := registry.rooms[name]
+		if !ok {
+			continue
+		}
+		for _, webhook := range settings.Webhooks {
+			if webhook.Subscribed(event) {
+				webhooks = append(webhooks, webhook)
+			}
+		}
+	}
+	return webhooks
+}
+
+// Reserved indicates whether a user holds a role in any room, such names may only be used with an identity token
+func (registry *RoomRegistry) Reserved(identity string) bool {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
+	for _, settings := range registry.rooms {
+		if _, ok := settings.Roles[identity]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Role returns the role of a user in a room
+func (registry *RoomRegistry) Role(room string, identity string) Role {
+	settings := registry.Get(room)
+	return settings.Role(identity)
+}
+
+// Update changes a room's settings and sends them to the other servers
+func (registry *RoomRegistry) Update(name string, change func(settings *RoomSettings)) RoomSettings {
+	// The lock is held until the settings are stored, so concurrent changes of a room are not lost
+	registry.mutex.Lock()
+	settings := registry.get(name)
+	change(&settings)
+	settings.UpdatedAt = time.Now()
+	registry.store(&settings)
+	registry.mutex.Unlock()
+
+	if registry.distribute != nil {
+		distributed := settings.copy()
+		registry.distribute <- &distributed
+	}
+
+	return settings
+}
+
+// Apply stores a room's settings without sending them to the other servers.
+// Settings that are older than the stored ones are ignored.
+func (registry *RoomRegistry) Apply(settings *RoomSettings) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	if stored, ok := registry.rooms[settings.Name]; ok && stored.UpdatedAt.After(settings.UpdatedAt) {
+		return
+	}
+
+	registry.store(settings)
+}
+
+// store replaces a room's settings with a copy and persists them, the caller has to hold the lock
+func (registry *RoomRegistry) store(settings *RoomSettings) {
+	stored := settings.copy()
+	registry.rooms[settings.Name] = &stored
+	registry.save()
+}
+
+// save writes the room settings to the file, the caller has to hold the lock
+func (registry *RoomRegistry) save() {
+	if registry.path == "" {
+		return
+	}
+
+	list := make([]*RoomSettings, 0, len(registry.rooms))
+	for _, settings := range registry.rooms {
+		list = append(list, settings)
+	}
+
+	err := saveJSONFile(registry.path, list)
+	if err != nil {
+		log.Printf("Cannot persist room settings to %v: %v", registry.path, err)
+	}
+}
+
+// rejectInaccessible responds with an error and returns true if the user that sent the request may not join the room.
+// The password is read from the X-Room-Password header or the query.
+func rejectInaccessible(writer http.ResponseWriter, req *http.Request, room string) bool {
+	password := req.Header.Get("X-Room-Password")
+	if password == "" {
+		password = req.URL.Query().Get("password")
+	}
+
+	identity, verified, _ := requestIdentity(req)
+	err := rooms.Admit(room, identity, verified != "" && identity == verified, password)
+	if err == nil {
+		return false
+	}
+
+	status := http.StatusForbidden
+	if err == errWrongPassword {
+		status = http.StatusUnauthorized
+	}
+
+	http.Error(writer, err.Error(), status)
+	return true
+}
+
+// authorize checks whether the user's role allows sending the message into its room.
+// Users that did not verify their identity with a token have the room's default role.
+func authorize(identity string, verified bool, message *chat.Message) error {
+	settings := rooms.Get(message.Room)
+	role := settings.DefaultRole
+	if verified {
+		role = settings.Role(identity)
+	}
+
+	switch message.Type {
+	case chat.EditMessage, chat.DeleteMessage:
+		original, ok := history.Get(message.Room, message.Target)
+		if !ok {
+			return errors.New("the message does not exist")
+		}
+		if original.Sender != identity && !role.Can(PermModerateMessages) {
+			return errors.New("you are not allowed to change the messages of others")
+		}
+		if !role.Can(PermPost) {
+			return errors.New("you are not allowed to post in this room")
+		}
+	case chat.KickMessage:
+		if !role.Can(PermKick) || roleRanks[settings.Role(message.Target)] >= roleRanks[role] {
+			return errors.New("you are not allowed to kick this user")
+		}
+	case chat.TopicMessage:
+		if !role.Can(PermChangeSettings) {
+			return errors.New("you are not allowed to change the settings of this room")
+		}
+	default:
+		if !role.Can(PermPost) {
+			return errors.New("you are not allowed to post in this room")
+		}
+	}
+
+	return nil
+}
+
+// applyAction carries out the effect of a message that acts on a room.
+// Chat and system messages are added to the history. If the message changed the summary of a thread,
+// the update for the clients of this server is returned.
+func applyAction(wrapper *MessageWrapper) *chat.Message {
+	message := wrapper.message
+
+	switch message.Type {
+	case chat.EditMessage:
+		history.Edit(message.Room, message.Target, message.Text)
+	case chat.DeleteMessage:
+		return history.Delete(message.Room, message.Target)
+	case chat.KickMessage:
+		for _, client := range ActiveClients() {
+			if client.Identity() == message.Target {
+				client.Remove(message.Room, "You were kicked from the room by "+message.Sender)
+			}
+		}
+	case chat.TopicMessage:
+		// The settings are distributed by the registry, so only the server that received the message updates them.
+		// Writing the file and distributing the settings must not block the broadcasting loop.
+		if wrapper.source != DISTRIBUTOR {
+			topicChanges <- topicChange{room: message.Room, topic: message.Text}
+		}
+	default:
+		return history.Add(message)
+	}
+	return nil
+}
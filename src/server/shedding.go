@@ -0,0 +1,264 @@
+package main
+
+import (
+	"errors"
+	dto "github.com/prometheus/client_model/go"
+	"log"
+	"math"
+	"runtime"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Shedding levels, every level includes the actions of the lower ones
+const (
+	ShedNone = iota
+	// ShedThrottle lowers the rate limits of clients and drops low-priority messages
+	ShedThrottle
+	// ShedReject rejects new connections
+	ShedReject
+)
+
+// errOverloaded is returned to new connections while the server sheds load
+var errOverloaded = errors.New("the server is overloaded")
+
+// SheddingConfig holds the thresholds of the load signals. A threshold of 0 ignores the signal.
+type SheddingConfig struct {
+	// Interval is the period in which the signals are sampled
+	Interval time.Duration
+	// QueueDepth is the number of messages waiting in the incoming queue
+	QueueDepth int
+	// ProcessingTime is the mean time to process a message within the interval
+	ProcessingTime time.Duration
+	Goroutines     int
+	// GCPause is the longest garbage collection pause within the interval
+	GCPause time.Duration
+	// RejectPercent is the load in percent of the thresholds at which new connections are rejected
+	RejectPercent int
+	// RecoveryPercent is the load in percent of the thresholds below which the shedding stops
+	RecoveryPercent int
+	// RateLimit is the number of messages per second a client may send while the load is shed
+	RateLimit int
+}
+
+// LoadShedder samples the load of the server and decides how much load is shed
+type LoadShedder struct {
+	config SheddingConfig
+	level  int32
+	// The processing time histogram and the GC pauses are compared with the previous sample
+	processedCount uint64
+	processedSum   float64
+	sampledAt      time.Time
+}
+
+// shedder protects the server from overload, it never sheds load until initShedding is called
+var shedder = &LoadShedder{}
+
+// initShedding reads the thresholds from the SHED_* env variables and starts sampling the load.
+// Shedding is disabled by default and enabled with SHEDDING=true.
+func initShedding() {
+	if !getEnvBool("SHEDDING", false) {
+		log.Println("Load shedding is disabled")
+		return
+	}
+
+	shedder = NewLoadShedder(SheddingConfig{
+		Interval:        getEnvDuration("SHED_INTERVAL", time.Second),
+		QueueDepth:      getEnvInt("SHED_QUEUE_DEPTH", messageBufferSize*8/10),
+		ProcessingTime:  getEnvDuration("SHED_PROCESSING_TIME", 500*time.Millisecond),
+		Goroutines:      getEnvInt("SHED_GOROUTINES", 50000),
+		GCPause:         getEnvDuration("SHED_GC_PAUSE", 100*time.Millisecond),
+		RejectPercent:   getEnvInt("SHED_REJECT_PERCENT", 150),
+		RecoveryPercent: getEnvInt("SHED_RECOVERY_PERCENT", 80),
+		RateLimit:       getEnvInt("SHED_RATE_LIMIT", 1),
+	})
+
+	go shedder.Run()
+}
+
+// NewLoadShedder creates a shedder that does not shed load until it sampled the signals
+func NewLoadShedder(config SheddingConfig) *LoadShedder {
+	return &LoadShedder{config: config, sampledAt: time.Now()}
+}
+
+// Level returns the current shedding level
+func (shedder *LoadShedder) Level() int {
+	return int(atomic.LoadInt32(&shedder.level))
+}
+
+// Run samples the signals in the configured interval and adjusts the shedding level
+func (shedder *LoadShedder) Run() {
+	ticker := time.NewTicker(shedder.config.Interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		load := shedder.sample()
+		previous := shedder.Level()
+		level := shedder.levelFor(load, previous)
+		atomic.StoreInt32(&shedder.level, int32(level))
+
+		SheddingLoadGauge.Set(load)
+		SheddingLevelGauge.Set(float64(level))
+
+		if level != previous {
+			log.Printf("Load shedding level changed from %v to %v at %.0f%% load", previous, level, load*100)
+		}
+	}
+}
+
+// levelFor returns the shedding level for the load. Shedding starts once a signal reaches its threshold
+// and only stops after the load fell below the recovery percentage, so the level does not flap.
+func (shedder *LoadShedder) levelFor(load float64, previous int) int {
+	percent := load * 100
+	switch {
+	case percent >= float64(shedder.config.RejectPercent):
+		return ShedReject
+	case percent >= 100:
+		return ShedThrottle
+	case previous > ShedNone && percent >= float64(shedder.config.RecoveryPercent):
+		return ShedThrottle
+	}
+	return ShedNone
+}
+
+// sample reads the signals and returns the highest ratio of a signal to its threshold
+func (shedder *LoadShedder) sample() float64 {
+	now := time.Now()
+
+	queueDepth := float64(len(incoming))
+	goroutines := float64(runtime.NumGoroutine())
+	processingTime := shedder.meanProcessingTime()
+	gcPause := longestGCPause(shedder.sampledAt)
+	shedder.sampledAt = now
+
+	SheddingSignalGaugeVec.WithLabelValues("queue_depth").Set(queueDepth)
+	SheddingSignalGaugeVec.WithLabelValues("goroutines").Set(goroutines)
+	SheddingSignalGaugeVec.WithLabelValues("processing_seconds").Set(processingTime.Seconds())
+	SheddingSignalGaugeVec.WithLabelValues("gc_pause_seconds").Set(gcPause.Seconds())
+
+	return math.Max(
+		math.Max(ratio(queueDepth, float64(shedder.config.QueueDepth)), ratio(goroutines, float64(shedder.config.Goroutines))),
+		math.Max(ratio(processingTime.Seconds(), shedder.config.ProcessingTime.Seconds()), ratio(gcPause.Seconds(), shedder.config.GCPause.Seconds())),
+	)
+}
+
+// meanProcessingTime returns the mean of the processing time histogram since the previous sample
+func (shedder *LoadShedder) meanProcessingTime() time.Duration {
+	var metric dto.Metric
+	if err := MessageProcessingTime.Write(&metric); err != nil {
+		return 0
+	}
+
+	count := metric.GetHistogram().GetSampleCount()
+	sum := metric.GetHistogram().GetSampleSum()
+	defer func() {
+		shedder.processedCount, shedder.processedSum = count, sum
+	}()
+
+	if count <= shedder.processedCount {
+		return 0
+	}
+	mean := (sum - shedder.processedSum) / float64(count-shedder.processedCount)
+	return time.Duration(mean * float64(time.Second))
+}
+
+// RateLimit returns the number of messages per second and the burst a client may send,
+// which are lowered while the load is shed. A rate of 0 is unlimited.
+func (shedder *LoadShedder) RateLimit(rate int, burst int) (int, int) {
+	if shedder.Level() == ShedNone || shedder.config.RateLimit <= 0 {
+		return rate, burst
+	}
+
+	if rate == 0 || shedder.config.RateLimit < rate {
+		rate = shedder.config.RateLimit
+	}
+	if burst > rate {
+		burst = rate
+	}
+	return rate, burst
+}
+
+// DropsLowPriority indicates whether messages that are not essential are dropped, e.g. the replies of bots
+// and chat messages for clients that already lag behind
+func (shedder *LoadShedder) DropsLowPriority() bool {
+	return shedder.Level() >= ShedThrottle
+}
+
+// RejectsConnections indicates whether new connections are rejected
+func (shedder *LoadShedder) RejectsConnections() bool {
+	return shedder.Level() >= ShedReject
+}
+
+// longestGCPause returns the longest garbage collection pause that ended after the supplied time
+func longestGCPause(since time.Time) time.Duration {
+	var stats debug.GCStats
+	debug.ReadGCStats(&stats)
+
+	var longest time.Duration
+	for i, end := range stats.PauseEnd {
+		if end.Before(since) {
+			break
+		}
+		if stats.Pause[i] > longest {
+			longest = stats.Pause[i]
+		}
+	}
+	return longest
+}
+
+// ratio divides the value by the threshold, thresholds of 0 are ignored
+func ratio(value float64, threshold float64) float64 {
+	if threshold <= 0 {
+		return 0
+	}
+	return value / threshold
+}
+
+// rateLimiter is a token bucket that limits the messages a client sends. It is safe for concurrent use,
+// because SSE and long-polling clients send every message with its own request.
+type rateLimiter struct {
+	mutex     sync.Mutex
+	tokens    float64
+	updatedAt time.Time
+}
+
+// clientRateLimit and clientRateBurst limit the messages per second of every client, a rate of 0 is unlimited
+var (
+	clientRateLimit = 0
+	clientRateBurst = 10
+)
+
+// initRateLimits reads the limits of the clients from CLIENT_RATE_LIMIT and CLIENT_RATE_BURST
+func initRateLimits() {
+	clientRateLimit = getEnvInt("CLIENT_RATE_LIMIT", clientRateLimit)
+	clientRateBurst = getEnvInt("CLIENT_RATE_BURST", clientRateBurst)
+}
+
+// Allow takes a token from the bucket if there is one. The bucket refills with rate tokens per second up to burst.
+func (bucket *rateLimiter) Allow(now time.Time, rate int, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	if burst < 1 {
+		burst = 1
+	}
+
+	bucket.mutex.Lock()
+	defer bucket.mutex.Unlock()
+
+	if bucket.updatedAt.IsZero() {
+		bucket.tokens = float64(burst)
+	} else {
+		bucket.tokens += now.Sub(bucket.updatedAt).Seconds() * float64(rate)
+	}
+	bucket.tokens = math.Min(bucket.tokens, float64(burst))
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"scale-chat/chat"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// maxSpamEvents is the number of flagged messages that are kept for the admin API
+const maxSpamEvents = 100
+
+// SpamConfig holds the thresholds of the spam detection
+type SpamConfig struct {
+	// Window is the period in which the messages of a sender are compared
+	Window time.Duration
+	// MaxDuplicates is the number of identical messages a sender may send within the window
+	MaxDuplicates int
+	// MaxNearDuplicates is the number of similar messages a sender may send within the window
+	MaxNearDuplicates int
+	// Similarity is the share of character trigrams two messages need to have in common to be similar
+	Similarity float64
+	// MaxMentions is the number of mentions a single message may contain
+	MaxMentions int
+	// MaxChars is the number of characters a sender may send within the window
+	MaxChars int
+	// MuteDuration is the duration of the automatic mute of flagged senders, 0 disables automatic mutes
+	MuteDuration time.Duration
+}
+
+// SpamEvent describes a flagged message
+type SpamEvent struct {
+	Identity      string    `json:"identity,omitempty"`
+	Authenticated bool      `json:"authenticated"`
+	IP            string    `json:"ip,omitempty"`
+	Room          string    `json:"room"`
+	Reason        string    `json:"reason"`
+	Muted         bool      `json:"muted"`
+	FlaggedAt     time.Time `json:"flagged_at"`
+}
+
+// SpamMiddleware rejects messages of senders that repeat themselves, mention too many users
+// or send bursts of text, and mutes them temporarily
+type SpamMiddleware struct {
+	config  SpamConfig
+	mutex   sync.Mutex
+	senders map[string][]spamRecord
+	events  []SpamEvent
+	// calls counts the processed messages to sweep idle senders from time to time
+	calls int
+}
+
+// spamRecord is a message a sender sent within the window
+type spamRecord struct {
+	sentAt     time.Time
+	normalized string
+	trigrams   map[string]struct{}
+	length     int
+}
+
+// spamDetector is the spam middleware of the pipeline if it is configured, the admin API reads its events
+var spamDetector *SpamMiddleware
+
+// NewSpamMiddleware creates a spam detection with the supplied thresholds
+func NewSpamMiddleware(config SpamConfig) *SpamMiddleware {
+	return &SpamMiddleware{
+		config:  config,
+		senders: make(map[string][]spamRecord),
+	}
+}
+
+// newSpamMiddlewareFromEnv reads the thresholds from the SPAM_* env variables
+func newSpamMiddlewareFromEnv() (Middleware, error) {
+	spamDetector = NewSpamMiddleware(SpamConfig{
+		Window:            getEnvDuration("SPAM_WINDOW", 30*time.Second),
+		MaxDuplicates:     getEnvInt("SPAM_MAX_DUPLICATES", 3),
+		MaxNearDuplicates: getEnvInt("SPAM_MAX_NEAR_DUPLICATES", 5),
+		Similarity:        float64(getEnvInt("SPAM_SIMILARITY_PERCENT", 80)) / 100,
+		MaxMentions:       getEnvInt("SPAM_MAX_MENTIONS", 5),
+		MaxChars:          getEnvInt("SPAM_MAX_CHARS", 5000),
+		MuteDuration:      getEnvDuration("SPAM_MUTE_DURATION", 5*time.Minute),
+	})
+	return spamDetector, nil
+}
+
+func (spam *SpamMiddleware) Name() string {
+	return "spam"
+}
+
+// Process rejects the message if it is spam. Actions like deleting a message are not checked.
+func (spam *SpamMiddleware) Process(ctx *MessageContext, message *chat.Message) error {
+	if message.Type != "" && message.Type != chat.EditMessage {
+		return nil
+	}
+
+	// Anonymous users can change their name at will, so they are tracked by their address and session.
+	// The session keeps users behind the same address apart.
+	key := ctx.IP + "/" + ctx.Session
+	if ctx.Authenticated {
+		key = ctx.Identity
+	}
+
+	reason := spam.check(key, message.Text, time.Now())
+	if reason == "" {
+		return nil
+	}
+
+	SpamFlagsCounterVec.WithLabelValues(reason).Inc()
+
+	event := SpamEvent{
+		Identity:      ctx.Identity,
+		Authenticated: ctx.Authenticated,
+		IP:            ctx.IP,
+		Room:          message.Room,
+		Reason:        reason,
+		FlaggedAt:     time.Now(),
+	}
+
+	if spam.config.MuteDuration > 0 {
+		spam.mute(event)
+		event.Muted = true
+	}
+
+	log.Printf("Flagged message of %v as spam: %v", key, reason)
+	spam.record(event)
+
+	return fmt.Errorf("the message was flagged as spam (%v)", reason)
+}
+
+// Events returns the latest flagged messages
+func (spam *SpamMiddleware) Events() []SpamEvent {
+	spam.mutex.Lock()
+	defer spam.mutex.Unlock()
+
+	return append([]SpamEvent{}, spam.events...)
+}
+
+// check compares the message with the sender's previous messages and returns the reason if it is spam
+func (spam *SpamMiddleware) check(key string, text string, now time.Time) string {
+	if countMentions(text) > spam.config.MaxMentions {
+		return "mentions"
+	}
+
+	current := spamRecord{
+		sentAt:     now,
+		normalized: normalizeSpamText(text),
+		length:     len([]rune(text)),
+	}
+	current.trigrams = trigrams(current.normalized)
+
+	spam.mutex.Lock()
+	defer spam.mutex.Unlock()
+
+	spam.calls++
+	if spam.calls%1000 == 0 {
+		spam.sweep(now)
+	}
+
+	records := spam.recent(key, now)
+	spam.senders[key] = append(records, current)
+
+	duplicates, nearDuplicates, chars := 1, 1, current.length
+	for _, record := range records {
+		chars += record.length
+		if record.normalized == current.normalized {
+			duplicates++
+			nearDuplicates++
+		} else if similarity(record.trigrams, current.trigrams) >= spam.config.Similarity {
+			nearDuplicates++
+		}
+	}
+
+	switch {
+	case duplicates > spam.config.MaxDuplicates:
+		return "duplicates"
+	case nearDuplicates > spam.config.MaxNearDuplicates:
+		return "near_duplicates"
+	case chars > spam.config.MaxChars:
+		return "length_burst"
+	}
+	return ""
+}
+
+// recent returns the sender's messages within the window, the caller has to hold the lock
+func (spam *SpamMiddleware) recent(key string, now time.Time) []spamRecord {
+	records := spam.senders[key]
+	for len(records) > 0 && now.Sub(records[0].sentAt) > spam.config.Window {
+		records = records[1:]
+	}
+	return records
+}
+
+// sweep forgets the senders that did not send messages within the window, the caller has to hold the lock
+func (spam *SpamMiddleware) sweep(now time.Time) {
+	for key := range spam.senders {
+		if records := spam.recent(key, now); len(records) > 0 {
+			spam.senders[key] = records
+		} else {
+			delete(spam.senders, key)
+		}
+	}
+}
+
+// mute silences the flagged sender. Authenticated senders are muted by their identity in all rooms.
+// Anonymous senders are muted by their address, which other users might share, so only in the room of the message.
+func (spam *SpamMiddleware) mute(event SpamEvent) {
+	expiresAt := event.FlaggedAt.Add(spam.config.MuteDuration)
+	sanction := Sanction{
+		Kind:      MuteSanction,
+		Reason:    "automatically muted for spam (" + event.Reason + ")",
+		ExpiresAt: &expiresAt,
+	}
+	if event.Authenticated {
+		sanction.Identity = event.Identity
+	} else {
+		sanction.IP = event.IP
+		sanction.Room = event.Room
+	}
+
+	moderation.Add(sanction)
+}
+
+// record keeps the event for the admin API
+func (spam *SpamMiddleware) record(event SpamEvent) {
+	spam.mutex.Lock()
+	defer spam.mutex.Unlock()
+
+	spam.events = append(spam.events, event)
+	if len(spam.events) > maxSpamEvents {
+		spam.events = spam.events[len(spam.events)-maxSpamEvents:]
+	}
+}
+
+// countMentions counts the words that start with @
+func countMentions(text string) int {
+	mentions := 0
+	for _, word := range strings.Fields(text) {
+		if len(word) > 1 && word[0] == '@' {
+			mentions++
+		}
+	}
+	return mentions
+}
+
+// normalizeSpamText lowercases the text and drops everything but letters and digits, so small variations are ignored.
+// Texts without letters and digits, like emojis, are only trimmed, so different ones are not taken for duplicates.
+func normalizeSpamText(text string) string {
+	var builder strings.Builder
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			builder.WriteRune(r)
+		}
+	}
+	if builder.Len() == 0 {
+		return strings.TrimSpace(text)
+	}
+	return builder.String()
+}
+
+// trigrams returns the set of character trigrams of a text
+func trigrams(text string) map[string]struct{} {
+	runes := []rune(text)
+	set := make(map[string]struct{})
+	for i := 0; i+3 <= len(runes); i++ {
+		set[string(runes[i:i+3])] = struct{}{}
+	}
+	return set
+}
+
+// similarity returns the Jaccard index of two trigram sets
+func similarity(a map[string]struct{}, b map[string]struct{}) float64 {
+	if len(a) == 0 || len(b) == 0 {
+		return 0
+	}
+
+	shared := 0
+	for trigram := range a {
+		if _, ok := b[trigram]; ok {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(a)+len(b)-shared)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"scale-chat/chat"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSpamConfig has small thresholds, so a few messages trigger them
+var testSpamConfig = SpamConfig{
+	Window:            time.Minute,
+	MaxDuplicates:     2,
+	MaxNearDuplicates: 3,
+	Similarity:        0.5,
+	MaxMentions:       2,
+	MaxChars:          100,
+	MuteDuration:      time.Minute,
+}
+
+// useModeration replaces the sanctions with an empty registry
+func useModeration(t *testing.T) {
+	previous := moderation
+	moderation = NewModeration("", nil)
+	t.Cleanup(func() { moderation = previous })
+}
+
+func TestSpamThresholds(t *testing.T) {
+	tests := []struct {
+		name  string
+		texts []string
+		// flagged is the index of the first message that is flagged, -1 if none is
+		flagged int
+		reason  string
+	}{
+		{"different messages", []string{"hello", "how are you", "fine, thanks"}, -1, ""},
+		{"duplicates", []string{"hello", "hello", "hello"}, 2, "duplicates"},
+		{"duplicates with variations", []string{"Hello!", "hello", "HELLO ..."}, 2, "duplicates"},
+		{"near duplicates", []string{"buy cheap stuff 1", "buy cheap stuff 22", "buy cheap stuff 333", "buy cheap stuff 4444"}, 3, "near_duplicates"},
+		{"mentions", []string{"@alice @bob", "@alice @bob @carol"}, 1, "mentions"},
+		{"length burst", []string{strings.Repeat("a", 60), strings.Repeat("b", 60)}, 1, "length_burst"},
+		{"different numbers", []string{"123", "456", "789"}, -1, ""},
+		{"different emojis", []string{"👍", "🎉", "❤️"}, -1, ""},
+		{"different punctuation", []string{"+1", "!!!", "???"}, -1, ""},
+		{"repeated emojis", []string{"👍", "👍", "👍"}, 2, "duplicates"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useModeration(t)
+			spam := NewSpamMiddleware(testSpamConfig)
+			ctx := &MessageContext{Identity: "alice", Authenticated: true, IP: "10.0.0.1"}
+
+			for i, text := range test.texts {
+				err := spam.Process(ctx, &chat.Message{Text: text, Room: "lobby"})
+				if flagged := err != nil; flagged != (i == test.flagged) {
+					t.Fatalf("message %v %q flagged: %v", i, text, err)
+				}
+			}
+
+			events := spam.Events()
+			if test.flagged < 0 {
+				if len(events) != 0 {
+					t.Errorf("got events %+v", events)
+				}
+				return
+			}
+			if len(events) != 1 || events[0].Reason != test.reason || !events[0].Muted {
+				t.Errorf("got events %+v, want one muting event for %v", events, test.reason)
+			}
+		})
+	}
+}
+
+func TestSpamWindow(t *testing.T) {
+	spam := NewSpamMiddleware(testSpamConfig)
+	now := time.Now()
+
+	spam.check("alice", "hello", now)
+	spam.check("alice", "hello", now)
+	if reason := spam.check("alice", "hello", now.Add(2*time.Minute)); reason != "" {
+		t.Errorf("messages outside the window were counted: %v", reason)
+	}
+
+	// Every sender has their own tally
+	if reason := spam.check("bob", "hello", now.Add(2*time.Minute)); reason != "" {
+		t.Errorf("messages of another sender were counted: %v", reason)
+	}
+}
+
+func TestSpamSharedAddress(t *testing.T) {
+	useModeration(t)
+	spam := NewSpamMiddleware(testSpamConfig)
+
+	// Anonymous users behind the same address have their own tallies
+	for _, session := range []string{"1", "2", "3"} {
+		ctx := &MessageContext{Identity: "guest", IP: "10.0.0.1", Session: session}
+		for i := 0; i < 2; i++ {
+			if err := spam.Process(ctx, &chat.Message{Text: "hello", Room: "lobby"}); err != nil {
+				t.Fatalf("message of session %v was flagged: %v", session, err)
+			}
+		}
+	}
+}
+
+func TestSpamMutes(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  MessageContext
+		// muted and spared are the identities and addresses that are checked for the mute
+		muted  []string
+		spared []string
+	}{
+		{"authenticated", MessageContext{Identity: "alice", Authenticated: true, IP: "10.0.0.1"}, []string{"alice", ""}, []string{"", "10.0.0.1"}},
+		{"anonymous", MessageContext{Identity: "alice", IP: "10.0.0.1", Session: "1"}, []string{"", "10.0.0.1"}, []string{"alice", ""}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			useModeration(t)
+			spam := NewSpamMiddleware(testSpamConfig)
+
+			for i := 0; i < 3; i++ {
+				_ = spam.Process(&test.ctx, &chat.Message{Text: "hello", Room: "lobby"})
+			}
+
+			if mute := moderation.Find(MuteSanction, test.muted[0], test.muted[1], "lobby"); mute == nil {
+				t.Errorf("%v is not muted", test.muted)
+			}
+			if mute := moderation.Find(MuteSanction, test.spared[0], test.spared[1], "lobby"); mute != nil {
+				t.Errorf("%v is muted by %+v", test.spared, mute)
+			}
+		})
+	}
+
+	t.Run("anonymous in other rooms", func(t *testing.T) {
+		useModeration(t)
+		spam := NewSpamMiddleware(testSpamConfig)
+
+		for i := 0; i < 3; i++ {
+			_ = spam.Process(&MessageContext{Identity: "alice", IP: "10.0.0.1", Session: "1"}, &chat.Message{Text: "hello", Room: "lobby"})
+		}
+		if mute := moderation.Find(MuteSanction, "bob", "10.0.0.1", "news"); mute != nil {
+			t.Errorf("the address is muted in another room by %+v", mute)
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		useModeration(t)
+		config := testSpamConfig
+		config.MuteDuration = 0
+		spam := NewSpamMiddleware(config)
+		ctx := &MessageContext{Identity: "alice", Authenticated: true}
+
+		for i := 0; i < 3; i++ {
+			_ = spam.Process(ctx, &chat.Message{Text: "hello", Room: "lobby"})
+		}
+		if mute := moderation.Find(MuteSanction, "alice", "", "lobby"); mute != nil {
+			t.Errorf("alice is muted by %+v", mute)
+		}
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"log"
+	"net/http"
+	"scale-chat/chat"
+	"sync"
+)
+
+// errConnClosed is returned by ReadMessage if a connection was closed by the server
+var errConnClosed = errors.New("connection closed")
+
+// sseConn sends messages as Server-Sent Events. Clients send their messages via the send endpoint
+// with the session that is sent as first event.
+type sseConn struct {
+	session    string
+	remoteAddr string
+	writer     http.ResponseWriter
+	flusher    http.Flusher
+	ctx        context.Context
+	closed     chan struct{}
+	closeOnce  sync.Once
+}
+
+// ReadMessage blocks until the request is cancelled or the connection is closed,
+// because SSE clients send their messages via the send endpoint
+func (conn *sseConn) ReadMessage() (*chat.Message, error) {
+	select {
+	case <-conn.ctx.Done():
+		return nil, conn.ctx.Err()
+	case <-conn.closed:
+		return nil, errConnClosed
+	}
+}
+
+// WriteMessage writes the message as JSON encoded event to the response stream
+func (conn *sseConn) WriteMessage(message *chat.Message) error {
+	data, err := message.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+
+	_, err = fmt.Fprintf(conn.writer, "id: %s\nevent: message\ndata: %s\n\n", message.Id, data)
+	if err != nil {
+		return err
+	}
+	conn.flusher.Flush()
+
+	MessageBytesCounterVec.WithLabelValues("outgoing", chat.JSONCodec{}.Name()).Add(float64(len(data)))
+
+	return nil
+}
+
+func (conn *sseConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+	})
+	return nil
+}
+
+func (conn *sseConn) Session() string {
+	return conn.session
+}
+
+func (conn *sseConn) Transport() string {
+	return "sse"
+}
+
+func (conn *sseConn) RemoteAddr() string {
+	return conn.remoteAddr
+}
+
+// Handles the /sse endpoint and streams the messages of a room as Server-Sent Events
+func sseHandler(writer http.ResponseWriter, req *http.Request) {
+	log.Println("Got new SSE connection")
+
+	vars := mux.Vars(req)
+	room := vars["room"]
+	thread := req.URL.Query().Get("thread")
+
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		http.Error(writer, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	if rejectUnverified(writer, req) || rejectBanned(writer, req, room) || rejectInaccessible(writer, req, room) || rejectOverLimit(writer, req, room) {
+		return
+	}
+
+	session := uuid.New().String()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.Header().Set("Connection", "keep-alive")
+	// Prevent reverse proxies like nginx from buffering the stream
+	writer.Header().Set("X-Accel-Buffering", "no")
+	writer.Header().Set("X-Session-Id", session)
+	writer.WriteHeader(http.StatusOK)
+
+	// The session authenticates the messages the client sends via the send endpoint
+	_, _ = fmt.Fprintf(writer, "event: session\ndata: %s\n\n", session)
+	flusher.Flush()
+
+	conn := &sseConn{
+		session:    session,
+		remoteAddr: remoteAddress(req),
+		writer:     writer,
+		flusher:    flusher,
+		ctx:        req.Context(),
+		closed:     make(chan struct{}),
+	}
+
+	identity, verified, _ := requestIdentity(req)
+	StartClient(conn, room, thread, identity, verified)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"scale-chat/chat"
+	"sort"
+	"time"
+)
+
+// defaultMaxSubscriptions is the default number of rooms a single connection may subscribe to
+const defaultMaxSubscriptions = 20
+
+// maxSubscriptions limits the rooms of a connection including its default room
+var maxSubscriptions = defaultMaxSubscriptions
+
+// initSubscriptions reads the subscription limit from MAX_SUBSCRIPTIONS
+func initSubscriptions() {
+	maxSubscriptions = getEnvInt("MAX_SUBSCRIPTIONS", defaultMaxSubscriptions)
+}
+
+// Rooms returns the sorted rooms the client subscribed to, including its default room
+func (client *Client) Rooms() []string {
+	client.roomMutex.RLock()
+	defer client.roomMutex.RUnlock()
+
+	rooms := make([]string, 0, len(client.subscriptions))
+	for room := range client.subscriptions {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Subscribed indicates whether the client receives the messages of the room
+func (client *Client) Subscribed(room string) bool {
+	client.roomMutex.RLock()
+	defer client.roomMutex.RUnlock()
+	return client.subscriptions[room]
+}
+
+// Remove takes the client out of a room, e.g. because it was kicked or banned.
+// Clients are disconnected if the room is their default room.
+func (client *Client) Remove(room string, reason string) {
+	if room == client.Room() {
+		client.Kick(reason)
+		return
+	}
+
+	if client.unsubscribe(room) {
+		webhooks.Notify(WebhookLeave, room, client.Identity(), nil)
+		client.send(newSubscriptionMessage(chat.UnsubscribeMessage, room, reason))
+	}
+}
+
+// enforceBans removes the client from the rooms it is banned from and indicates whether it is disconnected
+func (client *Client) enforceBans() bool {
+	for _, room := range client.Rooms() {
+		if ban := moderation.Find(BanSanction, client.Identity(), client.IP(), room); ban != nil {
+			client.Remove(room, sanctionNotice(ban))
+			if room == client.Room() {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleSubscription adds the room of a subscribe frame to the client or removes the room of an unsubscribe frame.
+// The client receives a confirmation or a system message with the reason why the frame was refused.
+func (client *Client) handleSubscription(message *chat.Message) {
+	var err error
+	if message.Type == chat.SubscribeMessage {
+		err = client.Subscribe(message.Room, message.Text)
+	} else {
+		err = client.Unsubscribe(message.Room)
+	}
+
+	if err != nil {
+		client.Notify(err.Error())
+		return
+	}
+
+	SubscriptionCounterVec.WithLabelValues(message.Type).Inc()
+	client.send(newSubscriptionMessage(message.Type, message.Room, ""))
+}
+
+// Subscribe adds a room to the client if the client is allowed to join it
+func (client *Client) Subscribe(room string, password string) error {
+	if room == chat.AllRooms {
+		return errors.New("you cannot subscribe to all rooms")
+	}
+
+	// Thread clients only receive the messages of a single thread, which belongs to their default room
+	if client.thread != "" {
+		return errors.New("clients that follow a thread cannot subscribe to other rooms")
+	}
+
+	if client.Subscribed(room) {
+		return errors.New("you are already subscribed to room " + displayRoom(room))
+	}
+
+	identity := client.Identity()
+	if ban := moderation.Find(BanSanction, identity, client.IP(), room); ban != nil {
+		return errors.New(sanctionNotice(ban))
+	}
+
+	if err := rooms.Admit(room, identity, client.Authenticated(), password); err != nil {
+		return fmt.Errorf("you cannot subscribe to room %v: %w", displayRoom(room), err)
+	}
+
+	if err := limiter.AcquireRoom(room); err != nil {
+		return fmt.Errorf("you cannot subscribe to room %v: %w", displayRoom(room), err)
+	}
+
+	client.roomMutex.Lock()
+	if len(client.subscriptions) >= maxSubscriptions {
+		client.roomMutex.Unlock()
+		limiter.ReleaseRoom(room)
+		return fmt.Errorf("you cannot subscribe to more than %v rooms", maxSubscriptions)
+	}
+	client.subscriptions[room] = true
+	client.roomMutex.Unlock()
+
+	webhooks.Notify(WebhookJoin, room, identity, nil)
+	return nil
+}
+
+// Unsubscribe removes a room from the client. The default room can only be left by disconnecting.
+func (client *Client) Unsubscribe(room string) error {
+	if room == client.Room() {
+		return errors.New("you cannot unsubscribe from your default room, use /join or /leave instead")
+	}
+
+	if !client.unsubscribe(room) {
+		return errors.New("you are not subscribed to room " + displayRoom(room))
+	}
+
+	webhooks.Notify(WebhookLeave, room, client.Identity(), nil)
+	return nil
+}
+
+// unsubscribe removes the room from the subscriptions and indicates whether the client was subscribed
+func (client *Client) unsubscribe(room string) bool {
+	client.roomMutex.Lock()
+	defer client.roomMutex.Unlock()
+
+	if !client.subscriptions[room] {
+		return false
+	}
+	delete(client.subscriptions, room)
+	limiter.ReleaseRoom(room)
+	return true
+}
+
+// dropSubscriptions removes all rooms from a client that disconnected and returns them
+func (client *Client) dropSubscriptions() []string {
+	client.roomMutex.Lock()
+	defer client.roomMutex.Unlock()
+
+	rooms := make([]string, 0, len(client.subscriptions))
+	for room := range client.subscriptions {
+		rooms = append(rooms, room)
+	}
+	client.subscriptions = make(map[string]bool)
+	return rooms
+}
+
+// newSubscriptionMessage creates the confirmation of a subscription change, the text is the reason if the server made the change
+func newSubscriptionMessage(messageType string, room string, text string) *chat.Message {
+	return &chat.Message{
+		Id:     uuid.New().String(),
+		Type:   messageType,
+		Text:   text,
+		Sender: chat.SystemMessage,
+		SentAt: time.Now(),
+		Room:   room,
+	}
+}
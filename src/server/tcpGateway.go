@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"log"
+	"net"
+	"scale-chat/chat"
+	"strings"
+	"time"
+)
+
+// maxLineSize is the maximum size of a line that is read from a TCP connection
+const maxLineSize = 1 << 20
+
+// tcpConn exchanges newline-delimited JSON encoded messages via a raw TCP connection
+type tcpConn struct {
+	netConn net.Conn
+	scanner *bufio.Scanner
+	room    string
+}
+
+// ListenTCP accepts connections that speak the line protocol on the supplied address.
+// The first line a client sends selects the room, optionally followed by a space and the room's password.
+// Every following line is a JSON encoded chat.Message.
+func ListenTCP(address string) {
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Fatal("Could not listen on TCP gateway port: ", err)
+	}
+
+	log.Println("TCP gateway will be listening for incoming connections on:", address)
+
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			log.Println("Cannot accept TCP connection:", err)
+			continue
+		}
+
+		go handleTCPConn(netConn)
+	}
+}
+
+// handleTCPConn reads the room of a new TCP connection and starts the client
+func handleTCPConn(netConn net.Conn) {
+	log.Println("Got new TCP connection")
+
+	scanner := bufio.NewScanner(netConn)
+	scanner.Buffer(make([]byte, 0, 4096), maxLineSize)
+
+	if !scanner.Scan() {
+		log.Println("TCP connection closed before selecting a room")
+		_ = netConn.Close()
+		return
+	}
+	room, password := strings.TrimSpace(scanner.Text()), ""
+	if i := strings.IndexByte(room, ' '); i >= 0 {
+		room, password = room[:i], strings.TrimSpace(room[i+1:])
+	}
+
+	err := rooms.Admit(room, "", false, password)
+	if err == nil {
+		err = limiter.Acquire(hostOf(netConn.RemoteAddr().String()), room)
+	}
+	if err != nil {
+		log.Println("Rejecting TCP connection:", err)
+		_, _ = netConn.Write([]byte(err.Error() + "\n"))
+		_ = netConn.Close()
+		return
+	}
+
+	StartClient(&tcpConn{netConn: netConn, scanner: scanner, room: room}, room, "", "", "")
+}
+
+// ReadMessage reads the next line and skips lines that are empty or cannot be decoded.
+// Messages without room and timestamp are completed, so they can be typed by hand.
+func (conn *tcpConn) ReadMessage() (*chat.Message, error) {
+	for conn.scanner.Scan() {
+		data := conn.scanner.Bytes()
+		if len(strings.TrimSpace(string(data))) == 0 {
+			continue
+		}
+
+		MessageBytesCounterVec.WithLabelValues("incoming", chat.JSONCodec{}.Name()).Add(float64(len(data)))
+
+		var message chat.Message
+		err := message.UnmarshalBinary(data)
+		if err != nil {
+			continue
+		}
+
+		if message.Room == "" {
+			message.Room = conn.room
+		}
+		if message.SentAt.IsZero() {
+			message.SentAt = time.Now()
+		}
+
+		return &message, nil
+	}
+
+	err := conn.scanner.Err()
+	if err == nil {
+		err = errConnClosed
+	}
+	return nil, err
+}
+
+// WriteMessage writes the JSON encoded message followed by a newline
+func (conn *tcpConn) WriteMessage(message *chat.Message) error {
+	data, err := message.MarshalBinary()
+	if err != nil {
+		return nil
+	}
+
+	_, err = conn.netConn.Write(append(data, '\n'))
+	if err != nil {
+		return err
+	}
+
+	MessageBytesCounterVec.WithLabelValues("outgoing", chat.JSONCodec{}.Name()).Add(float64(len(data)))
+
+	return nil
+}
+
+func (conn *tcpConn) Close() error {
+	return conn.netConn.Close()
+}
+
+func (conn *tcpConn) Transport() string {
+	return "tcp"
+}
+
+func (conn *tcpConn) RemoteAddr() string {
+	return conn.netConn.RemoteAddr().String()
+}
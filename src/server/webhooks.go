@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"net/http"
+	"scale-chat/chat"
+	"time"
+)
+
+// Webhook events
+const (
+	WebhookMessage = "message"
+	WebhookJoin    = "join"
+	WebhookLeave   = "leave"
+)
+
+// SignatureHeader carries the hex encoded HMAC-SHA256 of the request body, prefixed with "sha256="
+const SignatureHeader = "X-Scale-Chat-Signature"
+
+// Webhook receives the events of a room. Webhooks of the room AllRooms receive the events of all rooms.
+type Webhook struct {
+	Id     string `json:"id"`
+	Url    string `json:"url"`
+	Secret string `json:"secret,omitempty"`
+	// Events restricts the webhook to some events, it receives all events if it is empty
+	Events    []string  `json:"events,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// WebhookPayload is the JSON body that is posted to webhooks
+type WebhookPayload struct {
+	// Id identifies the delivery, it stays the same when a delivery is retried
+	Id         string        `json:"id"`
+	Event      string        `json:"event"`
+	Room       string        `json:"room"`
+	Identity   string        `json:"identity,omitempty"`
+	Message    *chat.Message `json:"message,omitempty"`
+	OccurredAt time.Time     `json:"occurred_at"`
+}
+
+// WebhookDispatcher delivers events to webhooks in the background
+type WebhookDispatcher struct {
+	queue       chan *webhookDelivery
+	client      *http.Client
+	maxAttempts int
+	backoff     time.Duration
+}
+
+// webhookDelivery is a payload that has to be posted to a webhook
+type webhookDelivery struct {
+	webhook Webhook
+	event   string
+	body    []byte
+	id      string
+	attempt int
+}
+
+// webhooks delivers the events of this server, it drops all events until initWebhooks is called
+var webhooks = &WebhookDispatcher{}
+
+// initWebhooks starts the delivery workers
+func initWebhooks() {
+	webhooks = NewWebhookDispatcher(
+		getEnvInt("WEBHOOK_QUEUE_SIZE", 1000),
+		getEnvInt("WEBHOOK_WORKERS", 4),
+		getEnvDuration("WEBHOOK_TIMEOUT", 5*time.Second),
+		getEnvInt("WEBHOOK_MAX_ATTEMPTS", 5),
+		getEnvDuration("WEBHOOK_BACKOFF", time.Second),
+	)
+}
+
+// NewWebhookDispatcher starts workers that deliver the queued events.
+// Failed deliveries are retried up to maxAttempts times, the delay starts at backoff and doubles with every attempt.
+func NewWebhookDispatcher(queueSize int, workers int, timeout time.Duration, maxAttempts int, backoff time.Duration) *WebhookDispatcher {
+	dispatcher := &WebhookDispatcher{
+		queue:       make(chan *webhookDelivery, queueSize),
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: maxAttempts,
+		backoff:     backoff,
+	}
+
+	for i := 0; i < workers; i++ {
+		go dispatcher.work()
+	}
+
+	return dispatcher
+}
+
+// NewWebhook creates a webhook with a random secret if none is supplied
+func NewWebhook(url string, secret string, events []string) Webhook {
+	if secret == "" {
+		random := make([]byte, 32)
+		_, err := rand.Read(random)
+		if err != nil {
+			log.Panicln("Cannot generate webhook secret:", err)
+		}
+		secret = hex.EncodeToString(random)
+	}
+
+	return Webhook{
+		Id:        uuid.New().String(),
+		Url:       url,
+		Secret:    secret,
+		Events:    events,
+		CreatedAt: time.Now(),
+	}
+}
+
+// Subscribed indicates whether the webhook receives the event
+func (webhook *Webhook) Subscribed(event string) bool {
+	if len(webhook.Events) == 0 {
+		return true
+	}
+	for _, subscribed := range webhook.Events {
+		if subscribed == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Notify queues the event for the webhooks of the room and the global webhooks. It never blocks,
+// events are dropped if the queue is full.
+func (dispatcher *WebhookDispatcher) Notify(event string, room string, identity string, message *chat.Message) {
+	if dispatcher.queue == nil {
+		return
+	}
+
+	targets := rooms.Webhooks(room, event)
+	if len(targets) == 0 {
+		return
+	}
+
+	payload := WebhookPayload{
+		Event:      event,
+		Room:       room,
+		Identity:   identity,
+		Message:    message,
+		OccurredAt: time.Now(),
+	}
+
+	for _, webhook := range targets {
+		payload.Id = uuid.New().String()
+
+		body, err := json.Marshal(payload)
+		if err != nil {
+			log.Println("Cannot marshal webhook payload:", err)
+			return
+		}
+
+		dispatcher.enqueue(&webhookDelivery{webhook: webhook, event: event, body: body, id: payload.Id})
+	}
+}
+
+// enqueue adds a delivery to the queue without blocking
+func (dispatcher *WebhookDispatcher) enqueue(delivery *webhookDelivery) {
+	select {
+	case dispatcher.queue <- delivery:
+		WebhookQueueGauge.Inc()
+	default:
+		WebhookDeliveriesCounterVec.WithLabelValues("dropped").Inc()
+		log.Println("Webhook queue is full, dropping delivery to", delivery.webhook.Url)
+	}
+}
+
+// work delivers queued events and schedules retries for failed deliveries
+func (dispatcher *WebhookDispatcher) work() {
+	for delivery := range dispatcher.queue {
+		WebhookQueueGauge.Dec()
+
+		delivery.attempt++
+		err := dispatcher.deliver(delivery)
+		if err == nil {
+			WebhookDeliveriesCounterVec.WithLabelValues("success").Inc()
+			continue
+		}
+
+		if delivery.attempt >= dispatcher.maxAttempts {
+			WebhookDeliveriesCounterVec.WithLabelValues("failure").Inc()
+			log.Printf("Giving up webhook delivery to %v after %v attempts: %v", delivery.webhook.Url, delivery.attempt, err)
+			continue
+		}
+
+		WebhookDeliveriesCounterVec.WithLabelValues("retry").Inc()
+
+		delay := dispatcher.backoff << (delivery.attempt - 1)
+		retry := delivery
+		time.AfterFunc(delay, func() {
+			dispatcher.enqueue(retry)
+		})
+	}
+}
+
+// deliver posts the signed payload to the webhook
+func (dispatcher *WebhookDispatcher) deliver(delivery *webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, delivery.webhook.Url, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Scale-Chat-Event", delivery.event)
+	req.Header.Set("X-Scale-Chat-Delivery", delivery.id)
+	req.Header.Set(SignatureHeader, Sign(delivery.webhook.Secret, delivery.body))
+
+	start := time.Now()
+	resp, err := dispatcher.client.Do(req)
+	WebhookDurationSeconds.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %v", resp.Status)
+	}
+	return nil
+}
+
+// Sign returns the value of the signature header for a request body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
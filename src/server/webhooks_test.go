@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/hmac"
+	"encoding/json"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookRequest is a delivery that reached the test server
+type webhookRequest struct {
+	header     http.Header
+	body       []byte
+	receivedAt time.Time
+}
+
+// webhookServer records the deliveries and answers the first failures of them with 500 Internal Server Error
+type webhookServer struct {
+	*httptest.Server
+	mutex    sync.Mutex
+	requests []webhookRequest
+	failures int
+	received chan struct{}
+}
+
+func newWebhookServer(t *testing.T, failures int) *webhookServer {
+	server := &webhookServer{failures: failures, received: make(chan struct{}, 100)}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+
+		server.mutex.Lock()
+		server.requests = append(server.requests, webhookRequest{header: req.Header.Clone(), body: body, receivedAt: time.Now()})
+		fail := len(server.requests) <= server.failures
+		server.mutex.Unlock()
+
+		if fail {
+			writer.WriteHeader(http.StatusInternalServerError)
+		} else {
+			writer.WriteHeader(http.StatusNoContent)
+		}
+		server.received <- struct{}{}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// await waits for the supplied number of deliveries
+func (server *webhookServer) await(t *testing.T, count int) []webhookRequest {
+	t.Helper()
+
+	for i := 0; i < count; i++ {
+		select {
+		case <-server.received:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %v of %v deliveries", i, count)
+		}
+	}
+
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+	return append([]webhookRequest(nil), server.requests...)
+}
+
+// useWebhook registers a webhook for the room in a fresh registry
+func useWebhook(t *testing.T, room string, webhook Webhook) {
+	previous := rooms
+	rooms = NewRoomRegistry("", nil)
+	rooms.Apply(&RoomSettings{Name: room, Webhooks: []Webhook{webhook}, UpdatedAt: time.Now()})
+	t.Cleanup(func() { rooms = previous })
+}
+
+func TestWebhookSignature(t *testing.T) {
+	server := newWebhookServer(t, 0)
+	useWebhook(t, "lobby", NewWebhook(server.URL, "secret", nil))
+
+	dispatcher := NewWebhookDispatcher(10, 1, time.Second, 1, time.Millisecond)
+	dispatcher.Notify(WebhookJoin, "lobby", "alice", nil)
+
+	request := server.await(t, 1)[0]
+
+	signature := request.header.Get(SignatureHeader)
+	if !hmac.Equal([]byte(signature), []byte(Sign("secret", request.body))) {
+		t.Errorf("signature %v does not match the body", signature)
+	}
+	if signature == Sign("other", request.body) {
+		t.Error("signature does not depend on the secret")
+	}
+
+	var payload WebhookPayload
+	if err := json.Unmarshal(request.body, &payload); err != nil {
+		t.Fatal("cannot decode payload:", err)
+	}
+	if payload.Event != WebhookJoin || payload.Room != "lobby" || payload.Identity != "alice" {
+		t.Errorf("unexpected payload %+v", payload)
+	}
+	if request.header.Get("X-Scale-Chat-Delivery") != payload.Id || request.header.Get("X-Scale-Chat-Event") != WebhookJoin {
+		t.Errorf("unexpected headers %v", request.header)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	const backoff = 50 * time.Millisecond
+
+	tests := []struct {
+		name        string
+		failures    int
+		maxAttempts int
+		deliveries  int
+	}{
+		{"succeeds at once", 0, 3, 1},
+		{"succeeds after retries", 2, 3, 3},
+		{"gives up", 5, 3, 3},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := newWebhookServer(t, test.failures)
+			useWebhook(t, "lobby", NewWebhook(server.URL, "secret", nil))
+
+			dispatcher := NewWebhookDispatcher(10, 1, time.Second, test.maxAttempts, backoff)
+			dispatcher.Notify(WebhookLeave, "lobby", "alice", nil)
+
+			requests := server.await(t, test.deliveries)
+
+			// No further attempts follow the last one
+			select {
+			case <-server.received:
+				t.Fatalf("got more than %v deliveries", test.deliveries)
+			case <-time.After(backoff << test.maxAttempts):
+			}
+
+			for i := 1; i < len(requests); i++ {
+				if requests[i].header.Get("X-Scale-Chat-Delivery") != requests[0].header.Get("X-Scale-Chat-Delivery") {
+					t.Errorf("attempt %v has another delivery id", i+1)
+				}
+
+				// The delay doubles with every attempt
+				delay := requests[i].receivedAt.Sub(requests[i-1].receivedAt)
+				if minimum := backoff << (i - 1); delay < minimum {
+					t.Errorf("attempt %v followed after %v, want at least %v", i+1, delay, minimum)
+				}
+			}
+		})
+	}
+}
+
+func TestWebhookQueueFull(t *testing.T) {
+	server := newWebhookServer(t, 0)
+	useWebhook(t, "lobby", NewWebhook(server.URL, "secret", nil))
+
+	// Without workers the queue is never drained
+	dispatcher := NewWebhookDispatcher(2, 0, time.Second, 1, time.Millisecond)
+	dropped := testutil.ToFloat64(WebhookDeliveriesCounterVec.WithLabelValues("dropped"))
+
+	for i := 0; i < 5; i++ {
+		dispatcher.Notify(WebhookMessage, "lobby", "alice", nil)
+	}
+
+	if queued := len(dispatcher.queue); queued != 2 {
+		t.Errorf("got %v queued deliveries, want 2", queued)
+	}
+	if got := testutil.ToFloat64(WebhookDeliveriesCounterVec.WithLabelValues("dropped")) - dropped; got != 3 {
+		t.Errorf("got %v dropped deliveries, want 3", got)
+	}
+
+	// Events of rooms without webhooks are not queued at all
+	dispatcher.Notify(WebhookMessage, "other", "alice", nil)
+	if got := testutil.ToFloat64(WebhookDeliveriesCounterVec.WithLabelValues("dropped")) - dropped; got != 3 {
+		t.Errorf("got %v dropped deliveries after an event without webhooks, want 3", got)
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/gorilla/websocket"
+	"log"
+	"scale-chat/chat"
+)
+
+// websocketConn exchanges messages via a websocket connection
+type websocketConn struct {
+	wsConn *websocket.Conn
+	// codec that was negotiated via the websocket subprotocol
+	codec       chat.Codec
+	messageType int
+	// compression indicates whether the permessage-deflate extension was negotiated
+	compression bool
+	// arrays indicates whether batches are sent as a single JSON array frame, which clients opt in to
+	arrays bool
+	// wire counts the bytes written to the underlying connection
+	wire       *countingConn
+	remoteAddr string
+}
+
+// newWebsocketConn wraps an upgraded websocket connection.
+// If compression was negotiated, messages above the compression threshold are sent compressed.
+// Batches are sent as JSON arrays if the client asked for it and negotiated the JSON codec.
+func newWebsocketConn(wsConn *websocket.Conn, compression bool, arrays bool, remoteAddr string) *websocketConn {
+	codec, ok := chat.CodecBySubprotocol(wsConn.Subprotocol())
+	if !ok {
+		codec = chat.Codecs[0]
+	}
+
+	messageType := websocket.TextMessage
+	if codec.Binary() {
+		messageType = websocket.BinaryMessage
+	}
+
+	// The underlying connection is only a countingConn if it was accepted by the public listener
+	wire, _ := wsConn.UnderlyingConn().(*countingConn)
+
+	return &websocketConn{
+		wsConn:      wsConn,
+		codec:       codec,
+		messageType: messageType,
+		compression: compression,
+		arrays:      arrays && isJSON(codec),
+		wire:        wire,
+		remoteAddr:  remoteAddr,
+	}
+}
+
+// ReadMessage reads the next message from the websocket connection and skips messages that cannot be decoded
+func (conn *websocketConn) ReadMessage() (*chat.Message, error) {
+	for {
+		_, data, err := conn.wsConn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		MessageBytesCounterVec.WithLabelValues("incoming", conn.codec.Name()).Add(float64(len(data)))
+
+		log.Printf("Received raw message: %s", data)
+
+		var message chat.Message
+		err = conn.codec.Unmarshal(data, &message)
+		if err != nil {
+			continue
+		}
+
+		return &message, nil
+	}
+}
+
+// WriteMessage encodes the message with the negotiated codec and writes it to the websocket connection.
+// Messages that cannot be encoded are skipped.
+func (conn *websocketConn) WriteMessage(message *chat.Message) error {
+	data, err := conn.codec.Marshal(message)
+	if err != nil {
+		return nil
+	}
+
+	return conn.write(data)
+}
+
+// WriteMessages writes a batch as a single JSON array frame if the client opted in,
+// otherwise the frames of the batch are coalesced into a single write
+func (conn *websocketConn) WriteMessages(messages []*chat.Message) error {
+	if conn.arrays {
+		data, err := chat.MarshalBatch(messages)
+		if err != nil {
+			return nil
+		}
+		return conn.write(data)
+	}
+
+	if conn.wire != nil {
+		conn.wire.Cork()
+	}
+
+	for _, message := range messages {
+		err := conn.WriteMessage(message)
+		if err != nil {
+			if conn.wire != nil {
+				_ = conn.wire.Uncork()
+			}
+			return err
+		}
+	}
+
+	if conn.wire != nil {
+		return conn.wire.Uncork()
+	}
+	return nil
+}
+
+// write sends the encoded data as a single frame
+func (conn *websocketConn) write(data []byte) error {
+	compress := conn.compression && len(data) >= compressionThreshold
+	if conn.compression {
+		conn.wsConn.EnableWriteCompression(compress)
+	}
+
+	var writtenBefore uint64
+	if conn.wire != nil {
+		writtenBefore = conn.wire.Written()
+	}
+
+	err := conn.wsConn.WriteMessage(conn.messageType, data)
+	if err != nil {
+		return err
+	}
+
+	if compress && conn.wire != nil {
+		CompressionBytesCounterVec.WithLabelValues("raw").Add(float64(len(data)))
+		CompressionBytesCounterVec.WithLabelValues("compressed").Add(float64(conn.wire.Written() - writtenBefore))
+	}
+
+	MessageBytesCounterVec.WithLabelValues("outgoing", conn.codec.Name()).Add(float64(len(data)))
+
+	return nil
+}
+
+// Close tries to close the websocket connection
+func (conn *websocketConn) Close() error {
+	log.Println("Trying to close websocket connection")
+	err := conn.wsConn.Close()
+	if err != nil {
+		log.Println("Failed to close websocket connection gracefully")
+		return err
+	}
+	return nil
+}
+
+func (conn *websocketConn) Transport() string {
+	return "websocket"
+}
+
+func (conn *websocketConn) RemoteAddr() string {
+	return conn.remoteAddr
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+)
+
+// The webhook receiver is a local stand-in for the HTTP endpoints that receive the chat server's webhooks.
+// It verifies the signature of every delivery and logs the payload. Failures can be simulated to test the retries.
+func main() {
+	address := flag.String("address", ":9090",
+		"The address the receiver listens on")
+
+	secret := flag.String("secret", "",
+		"The secret of the webhook, signatures are not verified if it is empty")
+
+	fail := flag.Int64("fail", 0,
+		"The number of deliveries that are answered with 500 Internal Server Error before the receiver accepts them")
+
+	flag.Parse()
+
+	http.Handle("/", newReceiver(*secret, *fail))
+
+	log.Println("Webhook receiver is listening on:", *address)
+
+	if err := http.ListenAndServe(*address, nil); err != nil {
+		log.Fatal("Serving the webhook receiver failed:", err)
+	}
+}
+
+// newReceiver creates the handler of the deliveries. The first fail deliveries with a valid signature are answered
+// with 500 Internal Server Error.
+func newReceiver(secret string, fail int64) http.HandlerFunc {
+	var received int64
+
+	return func(writer http.ResponseWriter, req *http.Request) {
+		body, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(writer, "cannot read body", http.StatusBadRequest)
+			return
+		}
+
+		if secret != "" && !validSignature(secret, body, req.Header.Get("X-Scale-Chat-Signature")) {
+			log.Printf("Rejected delivery %v with invalid signature", req.Header.Get("X-Scale-Chat-Delivery"))
+			http.Error(writer, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+
+		count := atomic.AddInt64(&received, 1)
+		if count <= fail {
+			log.Printf("Simulating failure %v/%v for delivery %v", count, fail, req.Header.Get("X-Scale-Chat-Delivery"))
+			http.Error(writer, "simulated failure", http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Received %v event: %s", req.Header.Get("X-Scale-Chat-Event"), body)
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// validSignature compares the signature header with the HMAC-SHA256 of the body
+func validSignature(secret string, body []byte, signature string) bool {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
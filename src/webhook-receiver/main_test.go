@@ -0,0 +1,77 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// sign computes the signature header the chat server sends with a delivery
+func sign(secret string, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post sends a delivery with the supplied signature to the handler and returns the status code
+func post(t *testing.T, handler http.Handler, body string, signature string) int {
+	t.Helper()
+
+	req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	req.Header.Set("X-Scale-Chat-Event", "message")
+	req.Header.Set("X-Scale-Chat-Delivery", "delivery")
+	if signature != "" {
+		req.Header.Set("X-Scale-Chat-Signature", signature)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, req)
+	return recorder.Code
+}
+
+func TestReceiverSignature(t *testing.T) {
+	body := `{"event":"message","room":"lobby"}`
+
+	tests := []struct {
+		name      string
+		secret    string
+		signature string
+		status    int
+	}{
+		{"valid signature", "secret", sign("secret", body), http.StatusNoContent},
+		{"wrong secret", "secret", sign("other", body), http.StatusUnauthorized},
+		{"tampered body", "secret", sign("secret", body+" "), http.StatusUnauthorized},
+		{"missing signature", "secret", "", http.StatusUnauthorized},
+		{"signature without prefix", "secret", strings.TrimPrefix(sign("secret", body), "sha256="), http.StatusUnauthorized},
+		{"verification disabled", "", "", http.StatusNoContent},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if status := post(t, newReceiver(test.secret, 0), body, test.signature); status != test.status {
+				t.Errorf("got status %v, want %v", status, test.status)
+			}
+		})
+	}
+}
+
+func TestReceiverSimulatesFailures(t *testing.T) {
+	body := `{"event":"join","room":"lobby"}`
+	handler := newReceiver("secret", 2)
+
+	// Rejected signatures do not count as deliveries
+	if status := post(t, handler, body, sign("other", body)); status != http.StatusUnauthorized {
+		t.Fatalf("got status %v for an invalid signature, want %v", status, http.StatusUnauthorized)
+	}
+
+	want := []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusNoContent, http.StatusNoContent}
+	for i, status := range want {
+		if got := post(t, handler, body, sign("secret", body)); got != status {
+			t.Errorf("delivery %v: got status %v, want %v", i+1, got, status)
+		}
+	}
+}